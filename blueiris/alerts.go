@@ -0,0 +1,77 @@
+package blueiris
+
+import (
+	"strings"
+	"time"
+)
+
+type Alert struct {
+	Camera string `json:"camera"`
+	Path   string `json:"path"`
+	Clip   string `json:"clip"`
+	Date   int64  `json:"date"`
+	Memo   string `json:"memo"`
+	Flags  int    `json:"flags"`
+}
+
+// Time returns when the alert was raised.
+func (a Alert) Time() time.Time {
+	return time.Unix(a.Date, 0)
+}
+
+// Labels returns the objects the AI detected in the alert.
+func (a Alert) Labels() []string {
+	return ParseLabels(a.Memo)
+}
+
+// ParseLabels parses the objects detected by the AI from an alert's memo, which is in the form
+// "person:87%,car:65%", as also passed to http actions by the &MEMO macro.
+func ParseLabels(memo string) []string {
+	var labels []string
+
+	for _, label := range strings.FieldsFunc(memo, func(r rune) bool { return r == ',' || r == ';' }) {
+		if i := strings.IndexByte(label, ':'); i != -1 {
+			label = label[:i]
+		}
+
+		label = strings.ToLower(strings.TrimSpace(label))
+		if label != "" && label != "nothing found" {
+			labels = append(labels, label)
+		}
+	}
+
+	return labels
+}
+
+// ListAlerts lists the alerts raised since the given time, for the given camera or for every
+// camera if camera is "index".
+func (b *Blueiris) ListAlerts(camera string, since time.Time) ([]Alert, error) {
+	return b.ListAlertsBetween(camera, since, time.Time{})
+}
+
+// ListAlertsBetween lists the alerts raised between start and end, for the given camera or for
+// every camera if camera is "index". A zero end lists every alert since start.
+func (b *Blueiris) ListAlertsBetween(camera string, start time.Time, end time.Time) ([]Alert, error) {
+	request := struct {
+		Cmd       string `json:"cmd"`
+		Camera    string `json:"camera"`
+		StartDate int64  `json:"startdate"`
+		EndDate   int64  `json:"enddate,omitempty"`
+	}{
+		Cmd:       "alertlist",
+		Camera:    camera,
+		StartDate: start.Unix(),
+		EndDate:   unixOrZero(end),
+	}
+
+	var response struct {
+		Data []Alert `json:"data"`
+	}
+
+	err := b.sendCommand(request, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Data, nil
+}
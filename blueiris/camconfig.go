@@ -0,0 +1,61 @@
+package blueiris
+
+import "fmt"
+
+// values of the camconfig pause parameter
+const (
+	pauseIndefinitely = -1
+	pauseResume       = 0
+)
+
+// EnableCamera enables or disables the camera, blueiris stops reading from disabled cameras
+// entirely.
+func (b *Blueiris) EnableCamera(camera string, enabled bool) error {
+	request := struct {
+		Cmd    string `json:"cmd"`
+		Camera string `json:"camera"`
+		Enable bool   `json:"enable"`
+	}{
+		Cmd:    "camconfig",
+		Camera: camera,
+		Enable: enabled,
+	}
+
+	return b.sendCamconfigRequest(camera, request)
+}
+
+// PauseCamera pauses the camera until it's resumed, or resumes it. Paused cameras keep streaming
+// but don't trigger or record.
+func (b *Blueiris) PauseCamera(camera string, paused bool) error {
+	pause := pauseResume
+	if paused {
+		pause = pauseIndefinitely
+	}
+
+	request := struct {
+		Cmd    string `json:"cmd"`
+		Camera string `json:"camera"`
+		Pause  int    `json:"pause"`
+	}{
+		Cmd:    "camconfig",
+		Camera: camera,
+		Pause:  pause,
+	}
+
+	return b.sendCamconfigRequest(camera, request)
+}
+
+func (b *Blueiris) sendCamconfigRequest(camera string, request interface{}) error {
+	var response struct {
+		Result string `json:"result"`
+	}
+
+	err := b.sendCommand(request, &response)
+	if err != nil {
+		return err
+	} else if response.Result != "success" {
+		return fmt.Errorf("failed to configure camera %s", camera)
+	}
+
+	return nil
+}
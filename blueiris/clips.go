@@ -0,0 +1,108 @@
+package blueiris
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Clip struct {
+	Camera string `json:"camera"`
+	Path   string `json:"path"`
+	Date   int64  `json:"date"`
+	// length of the clip in milliseconds
+	Msec     int64  `json:"msec"`
+	FileSize string `json:"filesize"`
+	Memo     string `json:"memo"`
+	Flags    int    `json:"flags"`
+}
+
+// Time returns when the clip started.
+func (c Clip) Time() time.Time {
+	return time.Unix(c.Date, 0)
+}
+
+// Duration returns the length of the clip.
+func (c Clip) Duration() time.Duration {
+	return time.Duration(c.Msec) * time.Millisecond
+}
+
+// ListClips lists the clips recorded between start and end, for the given camera or for every
+// camera if camera is "index". A zero end lists every clip since start.
+func (b *Blueiris) ListClips(camera string, start time.Time, end time.Time) ([]Clip, error) {
+	request := struct {
+		Cmd       string `json:"cmd"`
+		Camera    string `json:"camera"`
+		StartDate int64  `json:"startdate"`
+		EndDate   int64  `json:"enddate,omitempty"`
+	}{
+		Cmd:       "cliplist",
+		Camera:    camera,
+		StartDate: start.Unix(),
+		EndDate:   unixOrZero(end),
+	}
+
+	var response struct {
+		Data []Clip `json:"data"`
+	}
+
+	err := b.sendCommand(request, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Data, nil
+}
+
+// FetchClip opens a clip for download from the path given in the clip or alert list, passing on
+// the byte range, if any, so clients can seek. The caller must close the response's body.
+func (b *Blueiris) FetchClip(ctx context.Context, path string, byteRange string) (*http.Response, error) {
+	// the path ends up in the url, so make sure it can't be used to reach anything but a clip
+	if !isFileName(path) {
+		return nil, fmt.Errorf("%w: clip %q", ErrInvalidPath, path)
+	}
+
+	header := http.Header{}
+	if byteRange != "" {
+		header.Set("Range", byteRange)
+	}
+
+	// clips can be far bigger than anything else we fetch, so don't let the client's overall
+	// timeout cut the download off part way through
+	client := *b.client
+	client.Timeout = 0
+
+	response, err := b.get(ctx, &client, b.BaseUrl.JoinPath("clips", path), header)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("blueiris responded to clip request with %s", response.Status)
+	}
+
+	return response, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// ErrInvalidPath is returned when a clip or alert path isn't one blueiris would have given us
+var ErrInvalidPath = errors.New("invalid path")
+
+// isFileName checks the path is a single file name blueiris gave us, rather than something that
+// could walk out of the directory it's joined onto
+func isFileName(path string) bool {
+	return path != "" && !strings.ContainsAny(path, `/\`) && !strings.Contains(path, "..")
+}
@@ -0,0 +1,275 @@
+package blueiris
+
+import (
+	"context"
+	"github.com/brutella/hap/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the minimum time between any two requests the event loop makes to blueiris, so subscribing
+// to more kinds of events never turns into a flood of requests
+const defaultMinRequestGap = 250 * time.Millisecond
+
+// Event is one of the typed events published by Events.
+type Event interface {
+	isEvent()
+}
+
+// CamerasUpdated is published with the full camera list every time it's refreshed.
+type CamerasUpdated struct {
+	Cameras []Camera
+}
+
+// CameraOnlineChanged is published when a camera goes offline or comes back online.
+type CameraOnlineChanged struct {
+	Camera Camera
+	Online bool
+}
+
+// CameraTriggered is published when a camera starts or stops being triggered. Cameras are
+// assumed to start off untriggered.
+type CameraTriggered struct {
+	Camera    Camera
+	Triggered bool
+}
+
+// StatusUpdated is published with the server's status every time it's refreshed.
+type StatusUpdated struct {
+	Status Status
+}
+
+// ProfileChanged is published when the active profile changes, including once with the
+// initial profile, for which Previous is 0.
+type ProfileChanged struct {
+	Profile  int
+	Previous int
+}
+
+// NewAlert is published for each alert raised after the event loop started.
+type NewAlert struct {
+	Alert Alert
+}
+
+func (CamerasUpdated) isEvent()      {}
+func (CameraOnlineChanged) isEvent() {}
+func (CameraTriggered) isEvent()     {}
+func (StatusUpdated) isEvent()       {}
+func (ProfileChanged) isEvent()      {}
+func (NewAlert) isEvent()            {}
+
+// EventOptions controls how often the event loop asks blueiris for each kind of state, an
+// interval of 0 disables polling for it.
+type EventOptions struct {
+	CameraInterval time.Duration
+	StatusInterval time.Duration
+	AlertInterval  time.Duration
+	// the minimum time between any two requests, 0 for the default
+	MinRequestGap time.Duration
+}
+
+// Events runs a single loop polling blueiris for cameras, server status and alerts, and
+// publishes typed events to each subscriber as the state changes. Sharing the loop means every
+// feature driven by blueiris' state costs no extra requests.
+type Events struct {
+	bi      *Blueiris
+	options EventOptions
+
+	mutex       *sync.Mutex
+	subscribers []chan Event
+}
+
+func NewEvents(bi *Blueiris, options EventOptions) *Events {
+	if options.MinRequestGap <= 0 {
+		options.MinRequestGap = defaultMinRequestGap
+	}
+
+	return &Events{
+		bi:      bi,
+		options: options,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on. The loop waits for
+// each subscriber to accept an event before carrying on, so subscribers should keep up or give
+// a large enough buffer. The channel is closed once the loop stops.
+func (e *Events) Subscribe(buffer int) <-chan Event {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	ch := make(chan Event, buffer)
+	e.subscribers = append(e.subscribers, ch)
+
+	return ch
+}
+
+// a kind of state the loop polls, and when it's next due
+type eventPoll struct {
+	interval time.Duration
+	next     time.Time
+	poll     func(ctx context.Context)
+}
+
+// Run polls blueiris and publishes events until the context is cancelled.
+func (e *Events) Run(ctx context.Context) {
+	defer e.closeSubscribers()
+
+	state := &eventState{
+		online:      map[string]bool{},
+		triggered:   map[string]bool{},
+		alertsSince: time.Now(),
+		seenAlerts:  map[string]bool{},
+	}
+
+	var polls []*eventPoll
+	now := time.Now()
+	for _, poll := range []*eventPoll{
+		{interval: e.options.CameraInterval, poll: func(ctx context.Context) { e.pollCameras(ctx, state) }},
+		{interval: e.options.StatusInterval, poll: func(ctx context.Context) { e.pollStatus(ctx, state) }},
+		{interval: e.options.AlertInterval, poll: func(ctx context.Context) { e.pollAlerts(ctx, state) }},
+	} {
+		if poll.interval > 0 {
+			poll.next = now
+			polls = append(polls, poll)
+		}
+	}
+
+	if len(polls) == 0 {
+		<-ctx.Done()
+		return
+	}
+
+	for {
+		// run whichever poll is due next
+		next := polls[0]
+		for _, poll := range polls[1:] {
+			if poll.next.Before(next.next) {
+				next = poll
+			}
+		}
+
+		timer := time.NewTimer(time.Until(next.next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		next.poll(ctx)
+
+		// schedule from when the poll finished, but never sooner than the minimum gap so a
+		// slow blueiris or a short interval can't have us hammering it
+		finished := time.Now()
+		next.next = finished.Add(next.interval)
+		for _, poll := range polls {
+			if earliest := finished.Add(e.options.MinRequestGap); poll.next.Before(earliest) {
+				poll.next = earliest
+			}
+		}
+	}
+}
+
+// the state the loop diffs each poll against to work out which events to publish
+type eventState struct {
+	online    map[string]bool
+	triggered map[string]bool
+	profile   int
+
+	alertsSince time.Time
+	// alerts raised in the same second as the last alert we saw, which we'll get back again
+	seenAlerts map[string]bool
+}
+
+func (e *Events) pollCameras(ctx context.Context, state *eventState) {
+	cameras, err := e.bi.ListCameras()
+	if err != nil {
+		log.Info.Printf("failed to poll blueiris cameras: %s\n", err)
+		return
+	}
+
+	e.publish(ctx, CamerasUpdated{Cameras: cameras})
+
+	for _, camera := range cameras {
+		if camera.IsGroup || camera.IsSystem {
+			continue
+		}
+
+		if online, known := state.online[camera.Id]; known && online != camera.IsOnline {
+			e.publish(ctx, CameraOnlineChanged{Camera: camera, Online: camera.IsOnline})
+		}
+		state.online[camera.Id] = camera.IsOnline
+
+		if camera.IsTriggered != state.triggered[camera.Id] {
+			state.triggered[camera.Id] = camera.IsTriggered
+			e.publish(ctx, CameraTriggered{Camera: camera, Triggered: camera.IsTriggered})
+		}
+	}
+}
+
+func (e *Events) pollStatus(ctx context.Context, state *eventState) {
+	status, err := e.bi.Status()
+	if err != nil {
+		log.Info.Printf("failed to poll blueiris status: %s\n", err)
+		return
+	}
+
+	e.publish(ctx, StatusUpdated{Status: status})
+
+	if status.Profile != state.profile {
+		e.publish(ctx, ProfileChanged{Profile: status.Profile, Previous: state.profile})
+		state.profile = status.Profile
+	}
+}
+
+func (e *Events) pollAlerts(ctx context.Context, state *eventState) {
+	alerts, err := e.bi.ListAlerts("index", state.alertsSince)
+	if err != nil {
+		log.Info.Printf("failed to poll blueiris alerts: %s\n", err)
+		return
+	}
+
+	// blueiris lists the newest alerts first
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Date < alerts[j].Date })
+
+	for _, alert := range alerts {
+		if alert.Date < state.alertsSince.Unix() || state.seenAlerts[alert.Path] {
+			continue
+		}
+
+		if alert.Date > state.alertsSince.Unix() {
+			state.alertsSince = alert.Time()
+			state.seenAlerts = map[string]bool{}
+		}
+		state.seenAlerts[alert.Path] = true
+
+		e.publish(ctx, NewAlert{Alert: alert})
+	}
+}
+
+// publish sends the event to every subscriber, giving up if the context is cancelled
+func (e *Events) publish(ctx context.Context, event Event) {
+	e.mutex.Lock()
+	subscribers := e.subscribers
+	e.mutex.Unlock()
+
+	for _, ch := range subscribers {
+		select {
+		case ch <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *Events) closeSubscribers() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, ch := range e.subscribers {
+		close(ch)
+	}
+	e.subscribers = nil
+}
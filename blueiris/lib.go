@@ -2,21 +2,40 @@ package blueiris
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/brutella/hap/log"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type BlueirisConfig struct {
 	Instance string
 	Username string
 	Password string
+	// how long, in seconds, to wait for a connection to blueiris to be established
+	ConnectTimeout int `toml:"connect-timeout"`
+	// how long, in seconds, to wait for blueiris to respond to a request in full
+	Timeout int `toml:"timeout"`
+	// pem file of CA certificates to trust, on top of the system's, when blueiris is served over
+	// https
+	CaFile string `toml:"ca-file"`
+	// hex-encoded sha256 fingerprint of the certificate blueiris serves, which is trusted even if
+	// it's self-signed
+	Pin string `toml:"pin"`
+	// skip verifying blueiris' certificate entirely
+	InsecureSkipVerify bool `toml:"insecure-skip-verify"`
 }
 
 type Blueiris struct {
@@ -25,6 +44,9 @@ type Blueiris struct {
 	BaseUrl      *url.URL
 	username     string
 	password     string
+	client       *http.Client
+	dialer       *net.Dialer
+	tlsConfig    *tls.Config
 }
 
 func NewBlueiris(config BlueirisConfig) (*Blueiris, error) {
@@ -33,12 +55,39 @@ func NewBlueiris(config BlueirisConfig) (*Blueiris, error) {
 		return nil, err
 	}
 
+	connectTimeout := 5 * time.Second
+	if config.ConnectTimeout > 0 {
+		connectTimeout = time.Duration(config.ConnectTimeout) * time.Second
+	}
+
+	timeout := 10 * time.Second
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+
+	tlsConfig, err := newTlsConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSClientConfig = tlsConfig
+
 	bi := &Blueiris{
 		mutex:        &sync.RWMutex{},
 		sessionToken: "",
 		BaseUrl:      base,
 		username:     config.Username,
 		password:     config.Password,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+		dialer:    dialer,
+		tlsConfig: tlsConfig,
 	}
 
 	err = bi.login()
@@ -49,6 +98,35 @@ func NewBlueiris(config BlueirisConfig) (*Blueiris, error) {
 	return bi, nil
 }
 
+// StreamUrl returns the url of the camera's RTSP stream, over TLS if blueiris is served over
+// https.
+func (b *Blueiris) StreamUrl(camera string) *url.URL {
+	uri := b.BaseUrl.JoinPath(camera)
+
+	uri.Scheme = "rtsp"
+	if b.BaseUrl.Scheme == "https" {
+		uri.Scheme = "rtsps"
+	}
+
+	return uri
+}
+
+// DialStream connects to blueiris' RTSP server over TLS, verifying its certificate with the same
+// CA, pin or lack of verification as every other request. ffmpeg can't be given any of those for
+// rtsps, so streams from an https instance are pulled through this connection instead.
+func (b *Blueiris) DialStream(ctx context.Context) (net.Conn, error) {
+	port := b.BaseUrl.Port()
+	if port == "" {
+		port = rtspsDefaultPort
+	}
+
+	dialer := &tls.Dialer{NetDialer: b.dialer, Config: b.tlsConfig}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(b.BaseUrl.Hostname(), port))
+}
+
+// the port ffmpeg connects to for an rtsps url without one
+const rtspsDefaultPort = "322"
+
 func (b *Blueiris) getSessionToken() string {
 	cmd := struct {
 		Cmd string `json:"cmd"`
@@ -69,6 +147,34 @@ func (b *Blueiris) login() error {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
+	return b.loginLocked()
+}
+
+// renewSession logs in again after blueiris rejected the expired session, which happens
+// whenever blueiris restarts or the session times out. If another request has already renewed
+// the session there's nothing to do.
+func (b *Blueiris) renewSession(expired string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.sessionToken != expired {
+		return nil
+	}
+
+	log.Info.Println("blueiris session expired, logging in again")
+	return b.loginLocked()
+}
+
+// session returns the session requests should be authenticated with
+func (b *Blueiris) session() string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return b.sessionToken
+}
+
+// loginLocked starts a new session, the caller must hold the mutex
+func (b *Blueiris) loginLocked() error {
 	b.sessionToken = b.getSessionToken()
 
 	tokenHash := md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", b.username, b.sessionToken, b.password)))
@@ -99,32 +205,39 @@ func (b *Blueiris) login() error {
 }
 
 type Camera struct {
-	Id       string `json:"optionValue"`
-	Name     string `json:"optionDisplay"`
-	IsOnline bool   `json:"isOnline"`
-	HasAudio bool   `json:"audio"`
-	IsGroup  bool   `json:"group"`
-	IsSystem bool   `json:"is_system"`
-	Type     int    `json:"type"`
+	Id          string  `json:"optionValue"`
+	Name        string  `json:"optionDisplay"`
+	IsOnline    bool    `json:"isOnline"`
+	IsTriggered bool    `json:"isTriggered"`
+	IsEnabled   bool    `json:"isEnabled"`
+	IsPaused    bool    `json:"isPaused"`
+	IsPtz       bool    `json:"ptz"`
+	IsNoSignal  bool    `json:"isNoSignal"`
+	Fps         float64 `json:"FPS"`
+	Error       string  `json:"error"`
+	HasAudio    bool    `json:"audio"`
+	IsGroup     bool    `json:"group"`
+	IsSystem    bool    `json:"is_system"`
+	Type        int     `json:"type"`
 }
 
-func (b *Blueiris) ListCameras() ([]Camera, error) {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
+// IsHealthy checks that the camera is online and blueiris is receiving frames from it.
+func (c Camera) IsHealthy() bool {
+	return c.IsOnline && !c.IsNoSignal && c.Error == "" && c.Fps > 0
+}
 
+func (b *Blueiris) ListCameras() ([]Camera, error) {
 	request := struct {
-		Cmd     string `json:"cmd"`
-		Session string `json:"session"`
+		Cmd string `json:"cmd"`
 	}{
-		Cmd:     "camlist",
-		Session: b.sessionToken,
+		Cmd: "camlist",
 	}
 
 	var response struct {
 		Data []Camera `json:"data"`
 	}
 
-	err := b.sendRequest(request, &response)
+	err := b.sendCommand(request, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -132,56 +245,202 @@ func (b *Blueiris) ListCameras() ([]Camera, error) {
 	return response.Data, nil
 }
 
-//lint:ignore U1000 usage not yet implemented
-func (b *Blueiris) triggerCamera(camera string) error {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
-
+// TriggerCamera manually triggers the camera, causing blueiris to start recording it.
+func (b *Blueiris) TriggerCamera(camera string) error {
 	request := struct {
-		Cmd     string `json:"cmd"`
-		Camera  string `json:"camera"`
-		Session string `json:"session"`
+		Cmd    string `json:"cmd"`
+		Camera string `json:"camera"`
 	}{
-		Cmd:     "trigger",
-		Camera:  camera,
-		Session: b.sessionToken,
+		Cmd:    "trigger",
+		Camera: camera,
 	}
 
-	response := struct{}{}
+	var response struct {
+		Result string `json:"result"`
+	}
 
-	err := b.sendRequest(request, &response)
+	err := b.sendCommand(request, &response)
 	if err != nil {
 		return err
+	} else if response.Result != "success" {
+		return fmt.Errorf("failed to trigger camera %s", camera)
 	}
 
 	return nil
 }
 
-func (b *Blueiris) FetchSnapshot(camera string) (*http.Request, error) {
+// SnapshotOptions controls the size and quality of the image BlueIris returns, zero values leave
+// the BlueIris defaults in place
+type SnapshotOptions struct {
+	Width   int
+	Height  int
+	Quality int
+}
+
+// FetchSnapshot fetches the current image from the camera, returning early if the context is
+// cancelled.
+func (b *Blueiris) FetchSnapshot(ctx context.Context, camera string, options SnapshotOptions) ([]byte, error) {
 	uri := b.BaseUrl.JoinPath("image", camera)
-	uri.User = url.UserPassword(b.username, b.password)
-	return http.NewRequest("GET", uri.String(), nil)
+
+	query := uri.Query()
+	if options.Width > 0 {
+		query.Set("w", strconv.Itoa(options.Width))
+	}
+	if options.Height > 0 {
+		query.Set("h", strconv.Itoa(options.Height))
+	}
+	if options.Quality > 0 {
+		query.Set("q", strconv.Itoa(options.Quality))
+	}
+	uri.RawQuery = query.Encode()
+
+	return b.fetchImage(ctx, uri)
 }
 
-// TODO: try to renew session if result == 'fail'
-func (b *Blueiris) sendRequest(request interface{}, res any) error {
-	buf, err := json.Marshal(request)
+// FetchAlertImage fetches the full size image of the frame that raised an alert, from the path
+// given in the alert list or by the &ALERT_PATH macro.
+func (b *Blueiris) FetchAlertImage(ctx context.Context, path string) ([]byte, error) {
+	// the path can come from whoever calls the trigger endpoint, so make sure it can't be used to
+	// reach anything but an alert
+	if !isFileName(path) {
+		return nil, fmt.Errorf("%w: alert %q", ErrInvalidPath, path)
+	}
+
+	uri := b.BaseUrl.JoinPath("alerts", path)
+	uri.RawQuery = "fullsize=1"
+
+	return b.fetchImage(ctx, uri)
+}
+
+func (b *Blueiris) fetchImage(ctx context.Context, uri *url.URL) ([]byte, error) {
+	response, err := b.get(ctx, b.client, uri, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	// make sure we're not about to pass an error page off as an image
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("blueiris responded to image request with %s", response.Status)
+	} else if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("blueiris responded to image request with unexpected content type %s", contentType)
 	}
 
-	reader := bytes.NewReader(buf)
+	return io.ReadAll(response.Body)
+}
 
-	uri := b.BaseUrl.JoinPath("json")
-	response, err := http.Post(uri.String(), "application/json", reader)
+// get makes a GET request authenticated with our session, logging in again and retrying once
+// if blueiris has forgotten the session, either responding with a 401 or its login page. The
+// caller must close the response's body.
+func (b *Blueiris) get(ctx context.Context, client *http.Client, uri *url.URL, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		session := b.session()
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, uri.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for key, values := range header {
+			request.Header[key] = values
+		}
+
+		// authenticate using our existing session rather than sending our credentials with every
+		// request
+		request.AddCookie(&http.Cookie{Name: "session", Value: session})
+
+		response, err := client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		expired := response.StatusCode == http.StatusUnauthorized ||
+			strings.HasPrefix(response.Header.Get("Content-Type"), "text/html")
+		if !expired || attempt > 0 {
+			return response, nil
+		}
+
+		_, _ = io.Copy(io.Discard, response.Body)
+		_ = response.Body.Close()
+
+		if err := b.renewSession(session); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sendCommand sends a command to blueiris' json api, adding our session to the request. If
+// blueiris fails the command the session may have expired, so we log in again and retry once.
+func (b *Blueiris) sendCommand(request interface{}, res any) error {
+	// add the session to whichever request we've been given
+	buf, err := json.Marshal(request)
 	if err != nil {
 		return err
 	}
 
-	responseBytes, err := io.ReadAll(response.Body)
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		session := b.session()
+
+		fields["session"], err = json.Marshal(session)
+		if err != nil {
+			return err
+		}
+
+		responseBytes, err := b.post(fields)
+		if err != nil {
+			return err
+		}
+
+		var result struct {
+			Result string `json:"result"`
+		}
+		if err := json.Unmarshal(responseBytes, &result); err != nil {
+			return err
+		}
+
+		if result.Result != "fail" || attempt > 0 {
+			return json.Unmarshal(responseBytes, res)
+		}
+
+		if err := b.renewSession(session); err != nil {
+			return err
+		}
+	}
+}
+
+// sendRequest sends a request to blueiris' json api as is, without a session
+func (b *Blueiris) sendRequest(request interface{}, res any) error {
+	responseBytes, err := b.post(request)
 	if err != nil {
 		return err
 	}
 
 	return json.Unmarshal(responseBytes, res)
 }
+
+func (b *Blueiris) post(request interface{}) ([]byte, error) {
+	buf, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bytes.NewReader(buf)
+
+	uri := b.BaseUrl.JoinPath("json")
+	response, err := b.client.Post(uri.String(), "application/json", reader)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(response.Body)
+
+	return io.ReadAll(response.Body)
+}
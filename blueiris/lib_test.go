@@ -0,0 +1,127 @@
+package blueiris
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeBlueiris implements blueiris' two step login, handing out a new session for each challenge
+// and only accepting a response for a session it handed out
+type fakeBlueiris struct {
+	username string
+	password string
+
+	mutex    *sync.Mutex
+	sessions int
+	// the sessions handed out by the first step of the login, and those that completed the second
+	issued   map[string]bool
+	loggedIn map[string]bool
+	// every login response we've been sent
+	responses []map[string]string
+}
+
+func newFakeBlueiris(username string, password string) *fakeBlueiris {
+	return &fakeBlueiris{
+		username: username,
+		password: password,
+		mutex:    &sync.Mutex{},
+		issued:   map[string]bool{},
+		loggedIn: map[string]bool{},
+	}
+}
+
+func (f *fakeBlueiris) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var request map[string]string
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var response interface{}
+	switch {
+	case request["cmd"] == "login" && request["response"] == "":
+		f.sessions++
+		session := fmt.Sprintf("session-%d", f.sessions)
+		f.issued[session] = true
+		response = map[string]string{"result": "fail", "session": session}
+	case request["cmd"] == "login":
+		f.responses = append(f.responses, request)
+
+		session := request["session"]
+		expected := md5.Sum([]byte(fmt.Sprintf("%s:%s:%s", f.username, session, f.password)))
+		if !f.issued[session] || request["response"] != hex.EncodeToString(expected[:]) {
+			response = map[string]string{"result": "fail"}
+			break
+		}
+
+		f.loggedIn[session] = true
+		response = map[string]string{"result": "success", "session": session}
+	case !f.loggedIn[request["session"]]:
+		response = map[string]string{"result": "fail"}
+	default:
+		response = map[string]interface{}{"result": "success", "data": []Camera{{Id: "drive"}}}
+	}
+
+	_ = json.NewEncoder(res).Encode(response)
+}
+
+func TestLoginRespondsWithIssuedSession(t *testing.T) {
+	fake := newFakeBlueiris("user", "pass")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	bi, err := NewBlueiris(BlueirisConfig{Instance: server.URL, Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.responses) != 1 {
+		t.Fatalf("expected a single login response, got %d", len(fake.responses))
+	}
+	if session := fake.responses[0]["session"]; session != "session-1" {
+		t.Errorf("expected the login response to carry the session from the challenge, got %q", session)
+	}
+	if bi.session() != "session-1" {
+		t.Errorf("expected to be using the issued session, got %q", bi.session())
+	}
+}
+
+func TestSessionRenewedWhenForgotten(t *testing.T) {
+	fake := newFakeBlueiris("user", "pass")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	bi, err := NewBlueiris(BlueirisConfig{Instance: server.URL, Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// blueiris restarting forgets every session
+	fake.mutex.Lock()
+	fake.loggedIn = map[string]bool{}
+	fake.mutex.Unlock()
+
+	cameras, err := bi.ListCameras()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cameras) != 1 {
+		t.Errorf("expected the command to be retried once logged in again, got %d cameras", len(cameras))
+	}
+
+	if len(fake.responses) != 2 {
+		t.Fatalf("expected a second login, got %d", len(fake.responses))
+	}
+	if session := fake.responses[1]["session"]; session != "session-2" {
+		t.Errorf("expected the renewed login to carry the new session, got %q", session)
+	}
+}
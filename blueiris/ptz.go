@@ -0,0 +1,57 @@
+package blueiris
+
+import "fmt"
+
+// PtzButton is one of the buttons blueiris accepts in ptz commands
+type PtzButton int
+
+const (
+	PtzPanLeft  PtzButton = 0
+	PtzPanRight PtzButton = 1
+	PtzTiltUp   PtzButton = 2
+	PtzTiltDown PtzButton = 3
+	PtzHome     PtzButton = 4
+	PtzZoomIn   PtzButton = 5
+	PtzZoomOut  PtzButton = 6
+
+	// presets 1-20 are recalled with buttons 101-120
+	ptzPresetBase PtzButton = 100
+)
+
+// the number of presets blueiris supports for each camera
+const PtzPresets = 20
+
+// Ptz sends a movement command to a PTZ camera.
+func (b *Blueiris) Ptz(camera string, button PtzButton) error {
+	request := struct {
+		Cmd    string    `json:"cmd"`
+		Camera string    `json:"camera"`
+		Button PtzButton `json:"button"`
+	}{
+		Cmd:    "ptz",
+		Camera: camera,
+		Button: button,
+	}
+
+	var response struct {
+		Result string `json:"result"`
+	}
+
+	err := b.sendCommand(request, &response)
+	if err != nil {
+		return err
+	} else if response.Result != "success" {
+		return fmt.Errorf("failed to send ptz command to camera %s", camera)
+	}
+
+	return nil
+}
+
+// GotoPreset moves a PTZ camera to one of its presets, numbered 1-20.
+func (b *Blueiris) GotoPreset(camera string, preset int) error {
+	if preset < 1 || preset > PtzPresets {
+		return fmt.Errorf("preset %d is out of range 1-%d", preset, PtzPresets)
+	}
+
+	return b.Ptz(camera, ptzPresetBase+PtzButton(preset))
+}
@@ -0,0 +1,149 @@
+package blueiris
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// values of Status.Lock, controlling whether blueiris' schedule can change the active profile
+const (
+	ScheduleRun  = 0
+	ScheduleTemp = 1
+	ScheduleHold = 2
+)
+
+// Signal is blueiris' global traffic signal, which controls whether cameras trigger and record
+type Signal int
+
+const (
+	SignalRed    Signal = 0
+	SignalGreen  Signal = 1
+	SignalYellow Signal = 2
+)
+
+// UnmarshalJSON accepts the signal as either a number or a string, as blueiris sends it as a
+// string in some versions.
+func (s *Signal) UnmarshalJSON(data []byte) error {
+	signal, err := strconv.Atoi(strings.Trim(string(data), `"`))
+	if err != nil {
+		return fmt.Errorf("invalid signal %s: %w", data, err)
+	}
+
+	*s = Signal(signal)
+	return nil
+}
+
+// Disk is the usage of one of the disks blueiris is recording to
+type Disk struct {
+	Name  string `json:"disk"`
+	Free  int64  `json:"free"`
+	Total int64  `json:"total"`
+}
+
+type Status struct {
+	// the currently active profile, 1-7
+	Profile int `json:"profile"`
+	// whether the schedule is running, temporarily overridden or held
+	Lock int `json:"lock"`
+	// the name of the active schedule
+	Schedule string `json:"schedule"`
+	// the state of each of blueiris' digital inputs and outputs
+	Dio []bool `json:"dio"`
+	// the global traffic signal
+	Signal Signal `json:"signal"`
+	// cpu usage of the blueiris machine, as a percentage
+	Cpu int `json:"cpu"`
+	// memory used by blueiris, formatted for display, e.g. 1.2G
+	Memory string `json:"mem"`
+	// memory usage of the blueiris machine, as a percentage
+	MemoryLoad int    `json:"memload"`
+	Disks      []Disk `json:"disks"`
+	// the number of warnings in blueiris' log that haven't been looked at
+	Warnings int `json:"warnings"`
+}
+
+// Status fetches the current state of the blueiris server.
+func (b *Blueiris) Status() (Status, error) {
+	request := struct {
+		Cmd string `json:"cmd"`
+	}{
+		Cmd: "status",
+	}
+
+	return b.sendStatusRequest(request)
+}
+
+// SetProfile switches blueiris to the given profile, if hold is set the profile is held rather
+// than being changed back by the schedule.
+func (b *Blueiris) SetProfile(profile int, hold bool) (Status, error) {
+	lock := ScheduleTemp
+	if hold {
+		lock = ScheduleHold
+	}
+
+	request := struct {
+		Cmd     string `json:"cmd"`
+		Profile int    `json:"profile"`
+		Lock    int    `json:"lock"`
+	}{
+		Cmd:     "status",
+		Profile: profile,
+		Lock:    lock,
+	}
+
+	return b.sendStatusRequest(request)
+}
+
+// SetSignal changes blueiris' global traffic signal.
+func (b *Blueiris) SetSignal(signal Signal) (Status, error) {
+	request := struct {
+		Cmd    string `json:"cmd"`
+		Signal Signal `json:"signal"`
+	}{
+		Cmd:    "status",
+		Signal: signal,
+	}
+
+	return b.sendStatusRequest(request)
+}
+
+// SetOutput switches one of blueiris' digital outputs on or off. Blueiris can only toggle
+// outputs, so the output is only toggled if it isn't already in the requested state.
+func (b *Blueiris) SetOutput(output int, on bool) (Status, error) {
+	status, err := b.Status()
+	if err != nil {
+		return Status{}, err
+	} else if output < 0 || output >= len(status.Dio) {
+		return Status{}, fmt.Errorf("blueiris has no dio %d", output)
+	} else if status.Dio[output] == on {
+		return status, nil
+	}
+
+	request := struct {
+		Cmd string `json:"cmd"`
+		Dio int    `json:"dio"`
+	}{
+		Cmd: "status",
+		Dio: output,
+	}
+
+	return b.sendStatusRequest(request)
+}
+
+func (b *Blueiris) sendStatusRequest(request interface{}) (Status, error) {
+	var response struct {
+		Result string `json:"result"`
+		Data   Status `json:"data"`
+	}
+
+	err := b.sendCommand(request, &response)
+	if err != nil {
+		return Status{}, err
+	} else if response.Result != "success" {
+		return Status{}, errors.New("unsuccessful status request")
+	}
+
+	return response.Data, nil
+}
@@ -0,0 +1,65 @@
+package blueiris
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// newTlsConfig builds the tls config for connecting to blueiris, trusting the configured CA on
+// top of the system's and, if a pin is set, the certificate with that fingerprint whoever
+// signed it
+func newTlsConfig(config BlueirisConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CaFile != "" {
+		pem, err := os.ReadFile(config.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca-file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca-file %s", config.CaFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.Pin != "" && !config.InsecureSkipVerify {
+		pin, err := hex.DecodeString(strings.ReplaceAll(config.Pin, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, errors.New("pin must be the hex-encoded sha256 fingerprint of the certificate")
+		}
+
+		// the pinned certificate is trusted in place of the usual chain verification, which would
+		// reject a self-signed certificate before we got the chance to check it
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("blueiris didn't present a certificate")
+			}
+
+			fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if subtle.ConstantTimeCompare(fingerprint[:], pin) != 1 {
+				return fmt.Errorf("blueiris presented a certificate with fingerprint %x, which doesn't match the pin", fingerprint)
+			}
+
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
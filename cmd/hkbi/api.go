@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/brutella/hap/log"
+	"github.com/w4/hkbi/blueiris"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// how far back listings go if the request doesn't give a start time
+const defaultApiRange = 24 * time.Hour
+
+type ApiConfig struct {
+	// serve the clip and alert api
+	Enabled bool `toml:"enabled"`
+	// unlike the trigger endpoint, the api won't start without a secret
+	SharedSecretConfig
+}
+
+// Api exposes blueiris' recorded clips and alerts over http, so hkbi can be used as the single
+// gateway to blueiris.
+type Api struct {
+	bi *blueiris.Blueiris
+}
+
+type apiClip struct {
+	Camera   string    `json:"camera"`
+	Path     string    `json:"path"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration"`
+	FileSize string    `json:"fileSize"`
+	Download string    `json:"download"`
+}
+
+type apiAlert struct {
+	Camera   string    `json:"camera"`
+	Path     string    `json:"path"`
+	Clip     string    `json:"clip"`
+	Time     time.Time `json:"time"`
+	Labels   []string  `json:"labels"`
+	Memo     string    `json:"memo"`
+	Download string    `json:"download"`
+}
+
+func NewApi(bi *blueiris.Blueiris) *Api {
+	return &Api{bi: bi}
+}
+
+// Clips lists the clips recorded for the camera query parameter, or every camera if it's not
+// given, between the start and end query parameters.
+func (a *Api) Clips(res http.ResponseWriter, req *http.Request) {
+	camera, start, end, err := parseApiQuery(req.URL.Query())
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	clips, err := a.bi.ListClips(camera, start, end)
+	if err != nil {
+		log.Info.Printf("failed to list clips from blueiris: %s\n", err)
+		res.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	response := make([]apiClip, 0, len(clips))
+	for _, clip := range clips {
+		response = append(response, apiClip{
+			Camera:   clip.Camera,
+			Path:     clip.Path,
+			Time:     clip.Time(),
+			Duration: clip.Duration().Seconds(),
+			FileSize: clip.FileSize,
+			Download: downloadUrl(clip.Path),
+		})
+	}
+
+	writeJson(res, response)
+}
+
+// Alerts lists the alerts raised for the camera query parameter, or every camera if it's not
+// given, between the start and end query parameters.
+func (a *Api) Alerts(res http.ResponseWriter, req *http.Request) {
+	camera, start, end, err := parseApiQuery(req.URL.Query())
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	alerts, err := a.bi.ListAlertsBetween(camera, start, end)
+	if err != nil {
+		log.Info.Printf("failed to list alerts from blueiris: %s\n", err)
+		res.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	response := make([]apiAlert, 0, len(alerts))
+	for _, alert := range alerts {
+		response = append(response, apiAlert{
+			Camera:   alert.Camera,
+			Path:     alert.Path,
+			Clip:     alert.Clip,
+			Time:     alert.Time(),
+			Labels:   alert.Labels(),
+			Memo:     alert.Memo,
+			Download: downloadUrl(alert.Clip),
+		})
+	}
+
+	writeJson(res, response)
+}
+
+// Download proxies the clip at the path query parameter from blueiris, passing through range
+// requests so players can seek.
+func (a *Api) Download(res http.ResponseWriter, req *http.Request) {
+	clip, err := a.bi.FetchClip(req.Context(), req.URL.Query().Get("path"), req.Header.Get("Range"))
+	if errors.Is(err, blueiris.ErrInvalidPath) {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		if !errors.Is(err, req.Context().Err()) {
+			log.Info.Printf("failed to fetch clip from blueiris: %s\n", err)
+			res.WriteHeader(http.StatusBadGateway)
+		}
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(clip.Body)
+
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified"} {
+		if value := clip.Header.Get(header); value != "" {
+			res.Header().Set(header, value)
+		}
+	}
+	res.WriteHeader(clip.StatusCode)
+
+	_, _ = io.Copy(res, clip.Body)
+}
+
+// parseApiQuery reads the camera, start and end query parameters, times can either be RFC 3339
+// or unix timestamps
+func parseApiQuery(query url.Values) (camera string, start time.Time, end time.Time, err error) {
+	camera = query.Get("camera")
+	if camera == "" {
+		camera = "index"
+	}
+
+	end = time.Now()
+	if query.Has("end") {
+		end, err = parseApiTime(query.Get("end"))
+		if err != nil {
+			return "", time.Time{}, time.Time{}, fmt.Errorf("invalid end: %w", err)
+		}
+	}
+
+	start = end.Add(-defaultApiRange)
+	if query.Has("start") {
+		start, err = parseApiTime(query.Get("start"))
+		if err != nil {
+			return "", time.Time{}, time.Time{}, fmt.Errorf("invalid start: %w", err)
+		}
+	}
+
+	if start.After(end) {
+		return "", time.Time{}, time.Time{}, errors.New("start is after end")
+	}
+
+	return camera, start, end, nil
+}
+
+func parseApiTime(value string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// downloadUrl returns the path to download the clip from through the api, relative to hkbi
+func downloadUrl(clip string) string {
+	if clip == "" {
+		return ""
+	}
+
+	return "/api/clips/download?" + url.Values{"path": {clip}}.Encode()
+}
+
+func writeJson(res http.ResponseWriter, value any) {
+	res.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(res).Encode(value); err != nil {
+		log.Info.Printf("failed to write api response: %s\n", err)
+	}
+}
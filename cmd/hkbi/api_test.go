@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDownloadRejectsInvalidPath(t *testing.T) {
+	// the path is checked before blueiris is ever contacted
+	api := NewApi(nil)
+
+	for _, path := range []string{"", "../ui3.htm", "a/b.bvr", `a\b.bvr`} {
+		res := httptest.NewRecorder()
+		api.Download(res, httptest.NewRequest(http.MethodGet, "/api/clips/download?path="+url.QueryEscape(path), nil))
+
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("expected %d for path %q, got %d", http.StatusBadRequest, path, res.Code)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/brutella/hap/log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// header containing a hex-encoded HMAC-SHA256 of the request's query string, keyed with the
+// shared secret, for clients that would rather not send the secret itself
+const signatureHeader = "X-Hkbi-Signature"
+
+// how far a signed request's ts can be from our clock, so a captured request can only be replayed
+// for a short while
+const signatureWindow = 2 * time.Minute
+
+// SharedSecretConfig is embedded in the config for each set of endpoints guarded by a
+// SharedSecretAuth.
+type SharedSecretConfig struct {
+	// shared secret that must be passed as the token query parameter, or used to sign the query
+	// string, empty to not require one
+	Secret string `toml:"secret"`
+	// ip addresses or cidr ranges allowed to call the endpoint, empty to allow any address
+	AllowedIPs []string `toml:"allowed-ips"`
+}
+
+// SharedSecretAuth guards the endpoints that sit outside of HomeKit pairing, like the ones
+// blueiris calls into and the clip api, with a shared secret and an address allow list.
+type SharedSecretAuth struct {
+	secret  []byte
+	allowed []*net.IPNet
+}
+
+func NewSharedSecretAuth(config SharedSecretConfig) (*SharedSecretAuth, error) {
+	auth := &SharedSecretAuth{}
+
+	if config.Secret != "" {
+		auth.secret = []byte(config.Secret)
+	}
+
+	for _, allowed := range config.AllowedIPs {
+		if !strings.Contains(allowed, "/") {
+			ip := net.ParseIP(allowed)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address in allowed-ips: %s", allowed)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			auth.allowed = append(auth.allowed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(allowed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr range in allowed-ips: %s", allowed)
+		}
+
+		auth.allowed = append(auth.allowed, ipNet)
+	}
+
+	return auth, nil
+}
+
+// Wrap only passes requests through to the handler if they come from an allowed address and
+// carry the shared secret, responding with a 401 if the secret is missing and 403 otherwise.
+func (a *SharedSecretAuth) Wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if !a.isAllowedAddr(req.RemoteAddr) {
+			log.Info.Printf("rejecting %s request from disallowed address %s\n", req.URL.Path, req.RemoteAddr)
+			res.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if status := a.checkSecret(req); status != http.StatusOK {
+			log.Info.Printf("rejecting %s request from %s with missing or invalid secret\n", req.URL.Path, req.RemoteAddr)
+			res.WriteHeader(status)
+			return
+		}
+
+		handler(res, req)
+	}
+}
+
+func (a *SharedSecretAuth) isAllowedAddr(remoteAddr string) bool {
+	if len(a.allowed) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, allowed := range a.allowed {
+		if allowed.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *SharedSecretAuth) checkSecret(req *http.Request) int {
+	if a.secret == nil {
+		return http.StatusOK
+	}
+
+	// the secret itself in the query string, which is all blueiris' http actions can send
+	if token := req.URL.Query().Get("token"); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), a.secret) == 1 {
+			return http.StatusOK
+		}
+
+		return http.StatusForbidden
+	}
+
+	// or a signature of the query string
+	if signature := req.Header.Get(signatureHeader); signature != "" {
+		given, err := hex.DecodeString(signature)
+		if err != nil {
+			return http.StatusForbidden
+		}
+
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write([]byte(req.URL.RawQuery))
+		if !hmac.Equal(given, mac.Sum(nil)) {
+			return http.StatusForbidden
+		}
+
+		// the signature covers the ts, so it can't be moved forward without the secret
+		ts, err := strconv.ParseInt(req.URL.Query().Get("ts"), 10, 64)
+		if err != nil {
+			return http.StatusForbidden
+		}
+
+		if age := time.Since(time.Unix(ts, 0)); age > signatureWindow || age < -signatureWindow {
+			return http.StatusForbidden
+		}
+
+		return http.StatusOK
+	}
+
+	return http.StatusUnauthorized
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/BurntSushi/toml"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signedRequest(secret string, query string) *http.Request {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(query))
+
+	req := httptest.NewRequest(http.MethodGet, "/trigger?"+query, nil)
+	req.Header.Set(signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestCheckSecretSignature(t *testing.T) {
+	auth, err := NewSharedSecretAuth(SharedSecretConfig{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"current ts", signedRequest("secret", "cam=drive&ts="+strconv.FormatInt(now, 10)), http.StatusOK},
+		{"missing ts", signedRequest("secret", "cam=drive"), http.StatusForbidden},
+		{"expired ts", signedRequest("secret", "cam=drive&ts="+strconv.FormatInt(now-600, 10)), http.StatusForbidden},
+		{"future ts", signedRequest("secret", "cam=drive&ts="+strconv.FormatInt(now+600, 10)), http.StatusForbidden},
+		{"wrong secret", signedRequest("other", "cam=drive&ts="+strconv.FormatInt(now, 10)), http.StatusForbidden},
+		{"unsigned", httptest.NewRequest(http.MethodGet, "/trigger?cam=drive", nil), http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := auth.checkSecret(test.req); got != test.want {
+				t.Errorf("expected %d, got %d", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckSecretSignatureCoversTs(t *testing.T) {
+	auth, err := NewSharedSecretAuth(SharedSecretConfig{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a captured request with its ts swapped for a current one
+	req := signedRequest("secret", "cam=drive&ts="+strconv.FormatInt(time.Now().Unix()-600, 10))
+	req.URL.RawQuery = "cam=drive&ts=" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	if got := auth.checkSecret(req); got != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, got)
+	}
+}
+
+func TestSharedSecretConfigDecodes(t *testing.T) {
+	var config Config
+	_, err := toml.Decode(`
+[trigger]
+secret = "trigger-secret"
+allowed-ips = ["127.0.0.1"]
+
+[api]
+enabled = true
+secret = "api-secret"
+allowed-ips = ["192.168.1.0/24"]
+`, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Trigger.Secret != "trigger-secret" || len(config.Trigger.AllowedIPs) != 1 {
+		t.Errorf("unexpected trigger config %+v", config.Trigger)
+	}
+	if !config.Api.Enabled || config.Api.Secret != "api-secret" || len(config.Api.AllowedIPs) != 1 {
+		t.Errorf("unexpected api config %+v", config.Api)
+	}
+}
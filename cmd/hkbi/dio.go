@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/log"
+	"github.com/brutella/hap/service"
+	"github.com/w4/hkbi/blueiris"
+	"sync"
+)
+
+type DioConfig struct {
+	Name string `toml:"name"`
+	// the index of the blueiris dio, starting from 0
+	Index int `toml:"index"`
+	// either contact, for a contact sensor reflecting the state of an input, or switch, for a
+	// switch controlling an output
+	Type string `toml:"type"`
+	// flips the state, e.g. for contacts that are closed when the door is open
+	Invert bool `toml:"invert"`
+}
+
+// Dio exposes blueiris' digital inputs as contact sensors and its outputs as switches, polling
+// blueiris to keep them in sync.
+type Dio struct {
+	bi          *blueiris.Blueiris
+	accessories []*accessory.A
+
+	contacts map[int][]*dioContact
+	switches map[int][]*dioSwitch
+
+	mutex *sync.Mutex
+}
+
+type dioContact struct {
+	config DioConfig
+	sensor *service.ContactSensor
+}
+
+type dioSwitch struct {
+	config DioConfig
+	sw     *service.Switch
+}
+
+// NewDio creates an accessory for each of the configured dios, assigning ids using assignId.
+func NewDio(bi *blueiris.Blueiris, configs []DioConfig, assignId func(name string, minId int) uint64) (*Dio, error) {
+	d := &Dio{
+		bi:       bi,
+		contacts: map[int][]*dioContact{},
+		switches: map[int][]*dioSwitch{},
+		mutex:    &sync.Mutex{},
+	}
+
+	// names are used to assign accessory ids, so must be unique
+	names := map[string]bool{}
+	for _, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("dio %d has no name", config.Index)
+		} else if names[config.Name] {
+			return nil, fmt.Errorf("more than one dio is named %s", config.Name)
+		} else if config.Index < 0 {
+			return nil, fmt.Errorf("dio %s has a negative index", config.Name)
+		}
+
+		names[config.Name] = true
+
+		info := accessory.Info{
+			Name:         config.Name,
+			Manufacturer: "HKBI",
+		}
+
+		switch config.Type {
+		case "contact":
+			a := accessory.New(info, accessory.TypeSensor)
+			a.Id = assignId(fmt.Sprintf("hkbi:dio:%s", config.Name), 1000)
+
+			sensor := service.NewContactSensor()
+			a.AddS(sensor.S)
+
+			d.contacts[config.Index] = append(d.contacts[config.Index], &dioContact{config, sensor})
+			d.accessories = append(d.accessories, a)
+		case "switch":
+			a := accessory.NewSwitch(info)
+			a.Id = assignId(fmt.Sprintf("hkbi:dio:%s", config.Name), 1000)
+
+			config := config
+			sw := a.Switch
+			sw.On.OnValueRemoteUpdate(func(on bool) {
+				status, err := d.bi.SetOutput(config.Index, on != config.Invert)
+				if err != nil {
+					log.Info.Printf("failed to set dio %d: %s\n", config.Index, err)
+					sw.On.SetValue(!on)
+					return
+				}
+
+				d.update(status.Dio)
+			})
+
+			d.switches[config.Index] = append(d.switches[config.Index], &dioSwitch{config, sw})
+			d.accessories = append(d.accessories, a.A)
+		default:
+			return nil, fmt.Errorf("unknown type %s for dio %s", config.Type, config.Name)
+		}
+	}
+
+	return d, nil
+}
+
+// Accessories returns the accessories to expose to HomeKit.
+func (d *Dio) Accessories() []*accessory.A {
+	return d.accessories
+}
+
+// Run keeps the dios in sync with blueiris from the event loop, until the events channel
+// closes.
+func (d *Dio) Run(events <-chan blueiris.Event) {
+	for event := range events {
+		if event, ok := event.(blueiris.StatusUpdated); ok {
+			d.update(event.Status.Dio)
+		}
+	}
+}
+
+// update reflects the state of blueiris' dios in the accessories
+func (d *Dio) update(states []bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for index, state := range states {
+		for _, contact := range d.contacts[index] {
+			// a closed circuit means the contact is detected, i.e. the door is closed
+			value := characteristic.ContactSensorStateContactDetected
+			if state == contact.config.Invert {
+				value = characteristic.ContactSensorStateContactNotDetected
+			}
+
+			contact.sensor.ContactSensorState.SetValue(value)
+		}
+
+		for _, sw := range d.switches[index] {
+			sw.sw.On.SetValue(state != sw.config.Invert)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// InFlightRequests keeps count of the requests currently being handled, so they can be drained
+// before we shut down rather than being cut off mid-response.
+type InFlightRequests struct {
+	mutex    *sync.Mutex
+	wg       *sync.WaitGroup
+	draining bool
+}
+
+func NewInFlightRequests() *InFlightRequests {
+	return &InFlightRequests{
+		mutex: &sync.Mutex{},
+		wg:    &sync.WaitGroup{},
+	}
+}
+
+// Track wraps a handler so that it's counted while running, requests that arrive once we've
+// started draining are turned away with a 503.
+func (i *InFlightRequests) Track(handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		i.mutex.Lock()
+		if i.draining {
+			i.mutex.Unlock()
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		i.wg.Add(1)
+		i.mutex.Unlock()
+
+		defer i.wg.Done()
+		handler(res, req)
+	}
+}
+
+// Drain stops accepting new requests and waits for in-flight requests to finish, returning false
+// if they didn't finish within the timeout.
+func (i *InFlightRequests) Drain(timeout time.Duration) bool {
+	i.mutex.Lock()
+	i.draining = true
+	i.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		i.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/brutella/hap/rtp"
+	"sync"
+)
+
+// StreamLimiter caps the number of concurrent streams, both across every camera and for each
+// individual camera, and notifies cameras when their availability changes so that their
+// StreamingStatus can be kept in sync. Cameras blueiris reports as offline are unavailable
+// regardless of how many streams they have.
+type StreamLimiter struct {
+	mutex   *sync.Mutex
+	max     int
+	active  int
+	cameras map[string]*cameraLimit
+}
+
+type cameraLimit struct {
+	max      int
+	active   int
+	offline  bool
+	status   byte
+	onChange func(status byte)
+}
+
+// NewStreamLimiter creates a limiter allowing up to max concurrent streams across all cameras,
+// a max of 0 disables the global limit.
+func NewStreamLimiter(max int) *StreamLimiter {
+	return &StreamLimiter{
+		mutex:   &sync.Mutex{},
+		max:     max,
+		cameras: map[string]*cameraLimit{},
+	}
+}
+
+// Register adds a camera to the limiter allowing up to max concurrent streams for it, a max of
+// 0 disables the per-camera limit. onChange is called with the camera's new StreamingStatus
+// whenever it changes.
+func (l *StreamLimiter) Register(camera string, max int, onChange func(status byte)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.cameras[camera] = &cameraLimit{
+		max:      max,
+		status:   rtp.StreamingStatusAvailable,
+		onChange: onChange,
+	}
+}
+
+// SetOffline marks the camera as offline, making it unavailable for streaming, or back online.
+func (l *StreamLimiter) SetOffline(camera string, offline bool) {
+	l.mutex.Lock()
+
+	c := l.cameras[camera]
+	if c == nil || c.offline == offline {
+		l.mutex.Unlock()
+		return
+	}
+
+	c.offline = offline
+
+	changed := l.collectChanges()
+	l.mutex.Unlock()
+
+	notify(changed)
+}
+
+// Acquire reserves a stream slot for the camera, returning false if the camera is offline or
+// either the camera or the global limit has been reached.
+func (l *StreamLimiter) Acquire(camera string) bool {
+	l.mutex.Lock()
+
+	c := l.cameras[camera]
+	if c == nil || c.offline || l.isBusy(c) {
+		l.mutex.Unlock()
+		return false
+	}
+
+	c.active++
+	l.active++
+
+	changed := l.collectChanges()
+	l.mutex.Unlock()
+
+	notify(changed)
+	return true
+}
+
+// Release returns a stream slot previously reserved with Acquire.
+func (l *StreamLimiter) Release(camera string) {
+	l.mutex.Lock()
+
+	c := l.cameras[camera]
+	if c == nil || c.active == 0 {
+		l.mutex.Unlock()
+		return
+	}
+
+	c.active--
+	l.active--
+
+	changed := l.collectChanges()
+	l.mutex.Unlock()
+
+	notify(changed)
+}
+
+// Status returns the StreamingStatus that should currently be reported for the camera.
+func (l *StreamLimiter) Status(camera string) byte {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if c := l.cameras[camera]; c != nil {
+		return l.status(c)
+	}
+
+	return rtp.StreamingStatusAvailable
+}
+
+// status works out the StreamingStatus for the camera, the caller must hold the mutex.
+func (l *StreamLimiter) status(c *cameraLimit) byte {
+	if c.offline {
+		return rtp.StreamingStatusUnavailable
+	} else if l.isBusy(c) {
+		return rtp.StreamingStatusBusy
+	}
+
+	return rtp.StreamingStatusAvailable
+}
+
+// isBusy checks if the camera can't take any more streams, the caller must hold the mutex.
+func (l *StreamLimiter) isBusy(c *cameraLimit) bool {
+	return (l.max > 0 && l.active >= l.max) || (c.max > 0 && c.active >= c.max)
+}
+
+// collectChanges finds all the cameras whose status has changed since the last call, the
+// caller must hold the mutex. The returned callbacks should be called once the mutex has been
+// released.
+func (l *StreamLimiter) collectChanges() []func() {
+	var changed []func()
+
+	for _, c := range l.cameras {
+		status := l.status(c)
+		if status == c.status {
+			continue
+		}
+
+		c.status = status
+
+		onChange := c.onChange
+		changed = append(changed, func() { onChange(status) })
+	}
+
+	return changed
+}
+
+func notify(changed []func()) {
+	for _, fn := range changed {
+		fn()
+	}
+}
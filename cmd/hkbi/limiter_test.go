@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/brutella/hap/rtp"
+	"testing"
+)
+
+func TestStreamLimiterRefusesOfflineCamera(t *testing.T) {
+	limiter := NewStreamLimiter(0)
+
+	var statuses []byte
+	limiter.Register("driveway", 0, func(status byte) { statuses = append(statuses, status) })
+
+	limiter.SetOffline("driveway", true)
+	if limiter.Acquire("driveway") {
+		t.Error("expected an offline camera to be refused a slot")
+	}
+	if status := limiter.Status("driveway"); status != rtp.StreamingStatusUnavailable {
+		t.Errorf("expected unavailable status, got %d", status)
+	}
+
+	limiter.SetOffline("driveway", false)
+	if !limiter.Acquire("driveway") {
+		t.Error("expected a camera back online to be given a slot")
+	}
+
+	want := []byte{rtp.StreamingStatusUnavailable, rtp.StreamingStatusAvailable}
+	if string(statuses) != string(want) {
+		t.Errorf("expected status changes %v, got %v", want, statuses)
+	}
+}
@@ -3,42 +3,108 @@ package main
 import (
 	"context"
 	"encoding/gob"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/brutella/hap"
 	"github.com/brutella/hap/accessory"
 	"github.com/brutella/hap/characteristic"
 	"github.com/brutella/hap/log"
-	"github.com/brutella/hap/rtp"
 	"github.com/brutella/hap/service"
 	"github.com/brutella/hap/tlv8"
 	"github.com/w4/hkbi/blueiris"
 	service2 "github.com/w4/hkbi/service"
 	"io"
-	"math/rand"
-	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type Config struct {
 	ListenAddress string `toml:"listen-address"`
 	DataDir       string `toml:"data-dir"`
-	Blueiris      blueiris.BlueirisConfig
+	// how long to wait, in seconds, for requests and streams to finish when shutting down
+	ShutdownTimeout int `toml:"shutdown-timeout"`
+	Blueiris        blueiris.BlueirisConfig
+	Streaming       StreamingConfig
+	Snapshots       SnapshotConfig
+	Motion          MotionConfig
+	Trigger         SharedSecretConfig
+	SecuritySystem  SecuritySystemConfig `toml:"security-system"`
+	Dio             []DioConfig          `toml:"dio"`
+	Server          ServerConfig         `toml:"server"`
+	Api             ApiConfig            `toml:"api"`
+	Cameras         map[string]CameraConfig
+}
+
+type StreamingConfig struct {
+	// the maximum number of concurrent streams across all cameras, 0 for no limit
+	MaxStreams int `toml:"max-streams"`
+	// the range of udp ports to bind for rtp sessions, both 0 to let the OS pick
+	RtpPortMin int `toml:"rtp-port-min"`
+	RtpPortMax int `toml:"rtp-port-max"`
+}
+
+type SnapshotConfig struct {
+	// jpeg quality, 0-100, of the snapshots requested from blueiris, 0 for the blueiris default
+	Quality int `toml:"quality"`
+	// how long, in seconds, a snapshot is served from the cache before being fetched again
+	CacheTtl int `toml:"cache-ttl"`
+	// how long, in seconds, the frame that triggered a camera is served in place of its snapshot
+	EventDuration int `toml:"event-duration"`
+}
+
+type MotionConfig struct {
+	// how long, in seconds, a camera's motion sensor stays on after a trigger if blueiris doesn't
+	// turn it off, 0 to leave it on until blueiris does
+	Timeout int `toml:"timeout"`
+	// poll blueiris for triggered cameras rather than waiting for it to call the trigger endpoint
+	Poll bool `toml:"poll"`
+	// how often, in seconds, to poll blueiris for triggered cameras
+	PollInterval int `toml:"poll-interval"`
+}
+
+// per-camera configuration, keyed by the BlueIris short name of the camera
+type CameraConfig struct {
+	// the maximum number of concurrent streams for the camera, 0 for no limit
+	MaxStreams int `toml:"max-streams"`
+	// the kind of accessory to expose the camera as, either camera or doorbell
+	Type string `toml:"type"`
+	// overrides the motion timeout for the camera, -1 to disable it for just this camera
+	MotionTimeout int `toml:"motion-timeout"`
+	// objects detected by blueiris' AI to expose occupancy sensors for, either person, vehicle,
+	// animal or any other label the AI can detect
+	Objects []string `toml:"objects"`
+	// named presets, 1-20, of a PTZ camera to expose switches for recalling
+	Presets map[string]int `toml:"presets"`
+}
+
+// motionTimeout returns how long the camera's motion sensor should stay on after a trigger, 0
+// if it should stay on until blueiris turns it off
+func (c *Config) motionTimeout(camera string) time.Duration {
+	timeout := c.Motion.Timeout
+	if cameraTimeout := c.Cameras[camera].MotionTimeout; cameraTimeout != 0 {
+		timeout = cameraTimeout
+	}
+
+	if timeout <= 0 {
+		return 0
+	}
+
+	return time.Duration(timeout) * time.Second
 }
 
 type GlobalState struct {
-	ssrcVideo int32
-	ssrcAudio int32
+	limiter *StreamLimiter
+	ports   *PortAllocator
+	streams *StreamRegistry
 }
 
 func main() {
@@ -70,8 +136,9 @@ func run(config Config) {
 	}
 
 	globalState := &GlobalState{
-		ssrcVideo: rand.Int31(),
-		ssrcAudio: rand.Int31(),
+		limiter: NewStreamLimiter(config.Streaming.MaxStreams),
+		ports:   NewPortAllocator(config.Streaming.RtpPortMin, config.Streaming.RtpPortMax),
+		streams: NewStreamRegistry(),
 	}
 
 	// fetch cameras from BlueIris
@@ -105,9 +172,64 @@ func run(config Config) {
 
 	hasDiscoveredNewCameras := false
 
+	// assigns a stable id to the accessory with the given name, reusing the id it was given on a
+	// previous run if there was one, otherwise picking the next free id no lower than minId
+	assignId := func(name string, minId int) uint64 {
+		if id, exists := knownCameras[name]; exists {
+			log.Debug.Printf("reusing previously assigned id %d for %s", id, name)
+			return uint64(id)
+		}
+
+		newId := minId
+		for _, i := range knownCameras {
+			if i >= newId {
+				newId = i + 1
+			}
+		}
+
+		log.Info.Printf("newly discovered %s assigned id %d", name, newId)
+		knownCameras[name] = newId
+		hasDiscoveredNewCameras = true
+
+		return uint64(newId)
+	}
+
+	// optionally expose blueiris' profiles as a security system
+	var securitySystem *SecuritySystem
+	if config.SecuritySystem.Enabled {
+		securitySystem, err = NewSecuritySystem(bi, config.SecuritySystem)
+		if err != nil {
+			log.Info.Fatalf("failed to create security system: %s\n", err)
+		}
+
+		securitySystem.Id = assignId("hkbi:security-system", 1000)
+	}
+
+	// optionally expose the health of the blueiris server itself
+	var biServer *Server
+	if config.Server.Enabled {
+		biServer = NewServer(bi)
+		biServer.Id = assignId("hkbi:server", 1000)
+	}
+
+	// expose blueiris' digital inputs and outputs
+	var dio *Dio
+	if len(config.Dio) > 0 {
+		dio, err = NewDio(bi, config.Dio, assignId)
+		if err != nil {
+			log.Info.Fatalf("failed to create dio accessories: %s\n", err)
+		}
+	}
+
+	// keep track of the state of each camera, so we know when to serve placeholders instead of
+	// snapshots and can keep the camera switches in sync
+	cameraStatuses := NewCameraStatuses(biCameras)
+
 	// create HomeKit cameras and motion sensors from the fetched BlueIris cameras
 	cameras := make([]*accessory.Camera, 0, len(biCameras))
-	motionSensors := make(map[string]*service.MotionSensor)
+	motionSensors := make(map[string]*MotionTimer)
+	camerasByAid := make(map[uint64]blueiris.Camera)
+	doorbells := make(map[string]*service.Doorbell)
 	for _, camera := range biCameras {
 		// create the HomeKit camera accessory
 		cam := accessory.NewCamera(accessory.Info{
@@ -115,26 +237,22 @@ func run(config Config) {
 			Manufacturer: "HKBI",
 		})
 
-		if id, exists := knownCameras[camera.Name]; exists {
-			log.Debug.Printf("reusing previously assigned id %d for camera %s", id, camera.Name)
-			cam.Id = uint64(id)
-		} else {
-			newId := 0
-			for _, i := range knownCameras {
-				if i >= newId {
-					newId = i + 1
-				}
-			}
-
-			log.Info.Printf("newly discovered camera %s assigned id %d", camera.Name, newId)
-			knownCameras[camera.Name] = newId
-			cam.Id = uint64(newId)
+		cam.Id = assignId(camera.Name, 0)
 
-			hasDiscoveredNewCameras = true
+		// turn the camera into a video doorbell if it's configured as one, so iOS shows the rich
+		// doorbell notification when it's rung
+		var doorbell *service.Doorbell
+		switch config.Cameras[camera.Id].Type {
+		case "", "camera":
+		case "doorbell":
+			cam.Type = accessory.TypeVideoDoorbell
+			doorbell = service.NewDoorbell()
+		default:
+			log.Info.Fatalf("unknown type %s for camera %s\n", config.Cameras[camera.Id].Type, camera.Id)
 		}
 
 		// setup stream request handling on channel 1
-		startListeningForStreams(camera.Id, cam.StreamManagement1, globalState, &config, bi.BaseUrl)
+		startListeningForStreams(camera.Id, cam.StreamManagement1, globalState, &config, bi)
 
 		// create the camera operating mode service
 		cameraOperatingMode := service2.NewCameraOperatingMode()
@@ -145,17 +263,171 @@ func run(config Config) {
 		motionSensorActive := characteristic.NewActive()
 		motionSensor.AddC(motionSensorActive.C)
 
+		// surface the camera's health on the motion sensor, so a camera that's dropped off shows
+		// up in Home rather than only when someone tries to view it. the motion sensor is the last
+		// of the services hkbi has always exposed, so these don't shift the ids of any of them,
+		// the stream service reports an offline camera through its streaming status instead
+		motionStatusActive := characteristic.NewStatusActive()
+		motionSensor.AddC(motionStatusActive.C)
+		motionStatusFault := characteristic.NewStatusFault()
+		motionSensor.AddC(motionStatusFault.C)
+
+		setHealth := func(status blueiris.Camera) {
+			fault := characteristic.StatusFaultNoFault
+			if !status.IsHealthy() {
+				fault = characteristic.StatusFaultGeneralFault
+			}
+
+			motionStatusActive.SetValue(status.IsHealthy())
+			motionStatusFault.SetValue(fault)
+			globalState.limiter.SetOffline(status.Id, !status.IsOnline)
+		}
+		setHealth(camera)
+
 		// create camera recording management service
 		recordingManagement := service.NewCameraRecordingManagement()
 		cam.AddS(recordingManagement.S)
 
+		cameraId := camera.Id
+
 		// add motion sensor service to camera - TODO: needs to add to DataStreamManagement too
 		cam.AddS(motionSensor.S)
+		motionTimer := NewMotionTimer(motionSensor, config.motionTimeout(camera.Id))
+		if securitySystem != nil {
+			motionTimer.OnTrigger(func() { securitySystem.Motion(cameraId) })
+		}
+
+		// add an occupancy sensor for each of the objects the camera's AI detections should be
+		// surfaced for
+		for _, object := range config.Cameras[camera.Id].Objects {
+			occupancySensor := service.NewOccupancySensor()
+			occupancySensorName := characteristic.NewName()
+			occupancySensorName.SetValue(fmt.Sprintf("%s %s", camera.Name, object))
+			occupancySensor.AddC(occupancySensorName.C)
+
+			cam.AddS(occupancySensor.S)
+			motionTimer.AddObject(strings.ToLower(object), occupancySensor)
+		}
+
+		// hap numbers services and their characteristics in the order they're added, so anything
+		// new goes after the services hkbi has always exposed, and no characteristics are added to
+		// them other than at the end of the motion sensor, keeping their ids, and anything already
+		// set up against them, the same between versions
+
+		// add a switch to manually trigger blueiris to record the camera, which turns itself back
+		// off so it can be used from automations
+		triggerSwitch := service.NewSwitch()
+		triggerSwitchName := characteristic.NewName()
+		triggerSwitchName.SetValue(fmt.Sprintf("%s trigger recording", camera.Name))
+		triggerSwitch.AddC(triggerSwitchName.C)
+		cam.AddS(triggerSwitch.S)
+
+		triggerSwitch.On.OnValueRemoteUpdate(func(on bool) {
+			if !on {
+				return
+			}
+
+			if err := bi.TriggerCamera(cameraId); err != nil {
+				log.Info.Printf("failed to trigger camera %s: %s\n", cameraId, err)
+			}
+
+			time.AfterFunc(time.Second, func() {
+				triggerSwitch.On.SetValue(false)
+			})
+		})
+
+		// add switches to enable/disable and pause the camera in blueiris, e.g. while someone's
+		// working in view of it
+		enabledSwitch := service.NewSwitch()
+		enabledSwitchName := characteristic.NewName()
+		enabledSwitchName.SetValue(fmt.Sprintf("%s enabled", camera.Name))
+		enabledSwitch.AddC(enabledSwitchName.C)
+		enabledSwitch.On.SetValue(camera.IsEnabled)
+		cam.AddS(enabledSwitch.S)
+
+		enabledSwitch.On.OnValueRemoteUpdate(func(on bool) {
+			if err := bi.EnableCamera(cameraId, on); err != nil {
+				log.Info.Printf("failed to set camera %s enabled to %t: %s\n", cameraId, on, err)
+				enabledSwitch.On.SetValue(!on)
+			}
+		})
+
+		pausedSwitch := service.NewSwitch()
+		pausedSwitchName := characteristic.NewName()
+		pausedSwitchName.SetValue(fmt.Sprintf("%s paused", camera.Name))
+		pausedSwitch.AddC(pausedSwitchName.C)
+		pausedSwitch.On.SetValue(camera.IsPaused)
+		cam.AddS(pausedSwitch.S)
+
+		pausedSwitch.On.OnValueRemoteUpdate(func(on bool) {
+			if err := bi.PauseCamera(cameraId, on); err != nil {
+				log.Info.Printf("failed to set camera %s paused to %t: %s\n", cameraId, on, err)
+				pausedSwitch.On.SetValue(!on)
+			}
+		})
+
+		// pick up changes made from within blueiris itself
+		cameraStatuses.OnUpdate(func(status blueiris.Camera) {
+			if status.Id != cameraId {
+				return
+			}
+
+			enabledSwitch.On.SetValue(status.IsEnabled)
+			pausedSwitch.On.SetValue(status.IsPaused)
+			setHealth(status)
+		})
+
+		// add a switch for each of the camera's named PTZ presets, which like the trigger switch
+		// turn themselves back off once the camera's been moved. presets are sorted so the
+		// services keep the same ids between restarts
+		presets := config.Cameras[camera.Id].Presets
+		if len(presets) > 0 && !camera.IsPtz {
+			log.Info.Printf("camera %s has presets configured but isn't a ptz camera\n", camera.Id)
+		}
+
+		presetNames := make([]string, 0, len(presets))
+		for name := range presets {
+			presetNames = append(presetNames, name)
+		}
+		sort.Strings(presetNames)
+
+		for _, name := range presetNames {
+			preset := presets[name]
+			if preset < 1 || preset > blueiris.PtzPresets {
+				log.Info.Fatalf("preset %s for camera %s must be between 1 and %d\n", name, camera.Id, blueiris.PtzPresets)
+			}
+
+			presetSwitch := service.NewSwitch()
+			presetSwitchName := characteristic.NewName()
+			presetSwitchName.SetValue(fmt.Sprintf("%s %s", camera.Name, name))
+			presetSwitch.AddC(presetSwitchName.C)
+			cam.AddS(presetSwitch.S)
+
+			presetSwitch.On.OnValueRemoteUpdate(func(on bool) {
+				if !on {
+					return
+				}
+
+				if err := bi.GotoPreset(cameraId, preset); err != nil {
+					log.Info.Printf("failed to move camera %s to preset %d: %s\n", cameraId, preset, err)
+				}
+
+				time.AfterFunc(time.Second, func() {
+					presetSwitch.On.SetValue(false)
+				})
+			})
+		}
+
+		if doorbell != nil {
+			cam.AddS(doorbell.S)
+			doorbells[camera.Id] = doorbell
+		}
 
 		// add the cameras to our output array/map for adding to the server and dispatching
 		// events to
 		cameras = append(cameras, cam)
-		motionSensors[camera.Id] = motionSensor
+		motionSensors[camera.Id] = motionTimer
+		camerasByAid[cam.Id] = camera
 	}
 
 	// write newly discovered cameras to disk
@@ -178,6 +450,15 @@ func run(config Config) {
 	for _, camera := range cameras {
 		accessories = append(accessories, camera.A)
 	}
+	if securitySystem != nil {
+		accessories = append(accessories, securitySystem.A)
+	}
+	if dio != nil {
+		accessories = append(accessories, dio.Accessories()...)
+	}
+	if biServer != nil {
+		accessories = append(accessories, biServer.A)
+	}
 
 	// setup hap's state storage
 	fs := hap.NewFsStore(config.DataDir)
@@ -192,34 +473,114 @@ func run(config Config) {
 	server.Pin = "11111112"
 	server.Addr = config.ListenAddress
 
-	// endpoint to trigger a camera's motion sensor for 10 seconds
-	server.ServeMux().HandleFunc("/trigger", func(res http.ResponseWriter, req *http.Request) {
+	// cache snapshots so multiple devices refreshing at once don't each hit blueiris
+	snapshotTtl := 5 * time.Second
+	if config.Snapshots.CacheTtl > 0 {
+		snapshotTtl = time.Duration(config.Snapshots.CacheTtl) * time.Second
+	}
+	snapshots := NewSnapshotCache(snapshotTtl)
+
+	// grab the frame that triggered a camera as soon as we hear about it, so the snapshot iOS
+	// requests for the notification moments later actually shows what triggered it
+	eventDuration := 10 * time.Second
+	if config.Snapshots.EventDuration > 0 {
+		eventDuration = time.Duration(config.Snapshots.EventDuration) * time.Second
+	}
+	captureEventSnapshot := func(camera string, alertPath string) {
+		go func() {
+			var image []byte
+			var err error
+			if alertPath != "" {
+				image, err = bi.FetchAlertImage(context.Background(), alertPath)
+			} else {
+				image, err = bi.FetchSnapshot(context.Background(), camera, blueiris.SnapshotOptions{
+					Quality: config.Snapshots.Quality,
+				})
+			}
+			if err != nil {
+				log.Info.Printf("failed to capture event snapshot for %s: %s\n", camera, err)
+				return
+			}
+
+			snapshots.SetEvent(camera, image, eventDuration)
+		}()
+	}
+
+	// keep track of requests being handled, so we can let them finish when shutting down
+	inFlight := NewInFlightRequests()
+
+	// the trigger endpoint isn't protected by HomeKit pairing, so we need our own auth on it
+	triggerAuth, err := NewSharedSecretAuth(config.Trigger)
+	if err != nil {
+		log.Info.Fatalf("invalid trigger config: %s\n", err)
+	}
+
+	// endpoint to trigger a camera's motion sensor, clearing it after the configured timeout if
+	// blueiris doesn't clear it first
+	server.ServeMux().HandleFunc("/trigger", triggerAuth.Wrap(func(res http.ResponseWriter, req *http.Request) {
 		query := req.URL.Query()
 		state := query.Get("state")
 		cam := query.Get("cam")
+		labels := blueiris.ParseLabels(query.Get("labels"))
+
+		switch query.Get("event") {
+		case "", "motion":
+		case "ring":
+			if doorbell := doorbells[cam]; doorbell != nil {
+				doorbell.ProgrammableSwitchEvent.SetValue(characteristic.ProgrammableSwitchEventSinglePress)
+				captureEventSnapshot(cam, query.Get("alert"))
+				res.WriteHeader(http.StatusOK)
+			} else {
+				log.Info.Printf("Received ring request for camera that isn't a doorbell: %s", cam)
+				res.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		default:
+			log.Info.Printf("Received trigger request with unknown event: %s", query.Get("event"))
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
 		if sensor := motionSensors[cam]; sensor != nil {
-			var motionDetected bool
 			if state == "off" {
-				motionDetected = false
+				sensor.Reset()
 			} else {
-				motionDetected = true
+				sensor.Trigger(labels)
+				captureEventSnapshot(cam, query.Get("alert"))
 			}
 
-			sensor.MotionDetected.SetValue(motionDetected)
-
 			res.WriteHeader(http.StatusOK)
 		} else {
 			log.Info.Printf("Received trigger request for unknown camera: %s", cam)
 			res.WriteHeader(http.StatusBadRequest)
 		}
-	})
+	}))
+
+	// optionally serve blueiris' clips and alerts, again outside of HomeKit pairing so always
+	// behind a secret
+	if config.Api.Enabled {
+		if config.Api.Secret == "" {
+			log.Info.Fatalf("a secret must be set to enable the api\n")
+		}
+
+		apiAuth, err := NewSharedSecretAuth(config.Api.SharedSecretConfig)
+		if err != nil {
+			log.Info.Fatalf("invalid api config: %s\n", err)
+		}
+
+		api := NewApi(bi)
+		server.ServeMux().HandleFunc("/api/clips", apiAuth.Wrap(inFlight.Track(api.Clips)))
+		server.ServeMux().HandleFunc("/api/alerts", apiAuth.Wrap(inFlight.Track(api.Alerts)))
+		server.ServeMux().HandleFunc("/api/clips/download", apiAuth.Wrap(inFlight.Track(api.Download)))
+	}
 
 	// endpoint to handle snapshot requests from HomeKit
-	server.ServeMux().HandleFunc("/resource", func(res http.ResponseWriter, req *http.Request) {
+	server.ServeMux().HandleFunc("/resource", inFlight.Track(func(res http.ResponseWriter, req *http.Request) {
 		var request struct {
-			Type string `json:"resource-type"`
-			Aid  int    `json:"aid"`
+			Type   string `json:"resource-type"`
+			Aid    int    `json:"aid"`
+			Width  int    `json:"image-width"`
+			Height int    `json:"image-height"`
 		}
 
 		// ensure this is a valid resource request
@@ -247,15 +608,8 @@ func run(config Config) {
 			return
 		}
 
-		var cameraName string
-		for name, i := range knownCameras {
-			if i == request.Aid {
-				cameraName = name
-				break
-			}
-		}
-
-		if cameraName == "" {
+		camera, exists := camerasByAid[uint64(request.Aid)]
+		if !exists {
 			log.Info.Printf("a snapshot was requested for camera %d but not camera with that id exists", request.Aid)
 			res.WriteHeader(http.StatusBadRequest)
 			return
@@ -263,31 +617,62 @@ func run(config Config) {
 
 		switch request.Type {
 		case "image":
-			// build request to fetch a snapshot of the camera from blueiris
-			req, err := bi.FetchSnapshot(cameraName)
-			if err != nil {
-				log.Info.Println(err)
-				res.WriteHeader(http.StatusInternalServerError)
+			// serve the frame that triggered the camera if there's been a recent event, so rich
+			// notifications show what actually happened rather than the scene after the fact
+			if image := snapshots.Event(camera.Id); image != nil {
+				res.Header().Set("Content-Type", "image/jpeg")
+
+				wr := hap.NewChunkedWriter(res, 2048)
+				if _, err := wr.Write(image); err != nil {
+					log.Info.Printf("Failed to copy bytes for snapshot to HomeKit: %s\n", err)
+				}
 				return
 			}
 
-			// send request to blueiris
-			imageResponse, err := http.DefaultClient.Do(req)
+			key := snapshotKey{camera: camera.Id, width: request.Width, height: request.Height}
+
+			// grab the snapshot from our cache, or fetch it from blueiris at the size HomeKit asked for
+			// so the tile grid isn't pulling down full size images
+			image, staleSince, err := snapshots.Get(req.Context(), key, func(ctx context.Context) ([]byte, error) {
+				if !cameraStatuses.IsOnline(camera.Id) {
+					return nil, fmt.Errorf("camera %s is offline", camera.Id)
+				}
+
+				return bi.FetchSnapshot(ctx, camera.Id, blueiris.SnapshotOptions{
+					Width:   request.Width,
+					Height:  request.Height,
+					Quality: config.Snapshots.Quality,
+				})
+			})
+			if req.Context().Err() != nil {
+				// HomeKit gave up on the request, so there's nobody to send a fallback to
+				return
+			} else if err == nil && !staleSince.IsZero() {
+				// make it clear the snapshot is out of date, rather than passing it off as live
+				image, err = annotateStaleSnapshot(image, staleSince)
+			} else if err != nil {
+				// fall back to the last snapshot we managed to get, or a placeholder if we've never
+				// had one, so the Home app doesn't just show a broken tile
+				if last, fetchedAt := snapshots.Latest(camera.Id); last != nil {
+					image, err = annotateStaleSnapshot(last, fetchedAt)
+				} else if cameraStatuses.IsOnline(camera.Id) {
+					image, err = placeholderSnapshot(camera.Name, "unavailable", request.Width, request.Height)
+				} else {
+					image, err = placeholderSnapshot(camera.Name, "offline", request.Width, request.Height)
+				}
+			}
 			if err != nil {
 				log.Info.Println(err)
 				res.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			defer func(Body io.ReadCloser) {
-				_ = Body.Close()
-			}(imageResponse.Body)
 
 			// set response headers
 			res.Header().Set("Content-Type", "image/jpeg")
 
-			// stream response from blueiris to HomeKit
+			// send the snapshot to HomeKit
 			wr := hap.NewChunkedWriter(res, 2048)
-			_, err = io.Copy(wr, imageResponse.Body)
+			_, err = wr.Write(image)
 			if err != nil {
 				log.Info.Printf("Failed to copy bytes for snapshot to HomeKit: %s\n", err)
 				return
@@ -297,7 +682,12 @@ func run(config Config) {
 			res.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-	})
+	}))
+
+	shutdownTimeout := 10 * time.Second
+	if config.ShutdownTimeout > 0 {
+		shutdownTimeout = time.Duration(config.ShutdownTimeout) * time.Second
+	}
 
 	// set up a listener for sigint and sigterm signals to stop the server
 	c := make(chan os.Signal, 1)
@@ -305,273 +695,101 @@ func run(config Config) {
 	signal.Notify(c, syscall.SIGTERM)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		<-c
-		signal.Stop(c)
-		cancel()
-	}()
 
-	// spawn the server
-	err = server.ListenAndServe(ctx)
-	if err != nil {
-		log.Info.Panic(err)
+	// share a single loop polling blueiris between everything driven by its state
+	eventOptions := blueiris.EventOptions{CameraInterval: cameraStatusInterval}
+	if securitySystem != nil || dio != nil || biServer != nil {
+		eventOptions.StatusInterval = cameraStatusInterval
 	}
-}
-
-// sets up a camera accessory for streaming
-func startListeningForStreams(cameraName string, mgmt *service.CameraRTPStreamManagement, globalState *GlobalState, config *Config, blueirisBase *url.URL) {
-	// add active characteristic to rtpstream
-	active := characteristic.NewActive()
-	mgmt.AddC(active.C)
-
-	// set up some basic parameters for HomeKit to know that the camera is available
-	setTlv8Payload(mgmt.StreamingStatus.Bytes, rtp.StreamingStatus{Status: rtp.StreamingStatusAvailable})
-	setTlv8Payload(mgmt.SupportedRTPConfiguration.Bytes, rtp.NewConfiguration(rtp.CryptoSuite_AES_CM_128_HMAC_SHA1_80))
-	setTlv8Payload(mgmt.SupportedVideoStreamConfiguration.Bytes, rtp.DefaultVideoStreamConfiguration())
-	setTlv8Payload(mgmt.SupportedAudioStreamConfiguration.Bytes, rtp.DefaultAudioStreamConfiguration())
-
-	// shared state for all the spawned streams, with a mapping to the session id for us to
-	// figure out which stream is being referred to
-	var activeStreams = ActiveStreams{
-		mutex:   &sync.Mutex{},
-		streams: map[string]*Stream{},
-	}
-
-	// handle the initial request sent to us from HomeKit to set up a new stream
-	mgmt.SetupEndpoints.OnValueUpdate(func(new, old []byte, r *http.Request) {
-		// HomeKit ends up sending us two requests, but the second one doesn't have a http request attached,
-		// so we can just ignore it
-		if r == nil {
-			return
-		}
-
-		var req rtp.SetupEndpoints
-
-		// unmarshal request from HomeKit
-		err := tlv8.Unmarshal(new, &req)
-		if err != nil {
-			log.Info.Printf("Could not unmarshal tlv8 data: %s\n", err)
-			return
-		}
-
-		// encode the session id, so it's human-readable for logging
-		var uuid = hex.EncodeToString(req.SessionId)
-
-		// build the response to send back to HomeKit
-		resp := rtp.SetupEndpointsResponse{
-			SessionId: req.SessionId,
-			Status:    rtp.SessionStatusSuccess,
-			AccessoryAddr: rtp.Addr{
-				IPVersion:    req.ControllerAddr.IPVersion,
-				IPAddr:       strings.Split(r.Context().Value(http.LocalAddrContextKey).(net.Addr).String(), ":")[0],
-				VideoRtpPort: req.ControllerAddr.VideoRtpPort,
-				AudioRtpPort: req.ControllerAddr.AudioRtpPort,
-			},
-			Video:     req.Video,
-			Audio:     req.Audio,
-			SsrcVideo: globalState.ssrcVideo,
-			SsrcAudio: globalState.ssrcAudio,
-		}
-
-		// create and track the new stream
-		activeStreams.mutex.Lock()
-		activeStreams.streams[uuid] = &Stream{
-			mutex: &sync.Mutex{},
-			cmd:   nil,
-			req:   req,
-			resp:  resp,
+	if config.Motion.Poll {
+		pollInterval := 2 * time.Second
+		if config.Motion.PollInterval > 0 {
+			pollInterval = time.Duration(config.Motion.PollInterval) * time.Second
 		}
-		activeStreams.mutex.Unlock()
-
-		// send the response to HomeKit
-		setTlv8Payload(mgmt.SetupEndpoints.Bytes, resp)
-	})
-
-	// handle streaming requests from HomeKit
-	mgmt.SelectedRTPStreamConfiguration.OnValueRemoteUpdate(func(buf []byte) {
-		var cfg rtp.StreamConfiguration
-
-		// unmarshal request from HomeKit
-		err := tlv8.Unmarshal(buf, &cfg)
-		if err != nil {
-			log.Info.Fatalf("Could not unmarshal tlv8 data: %s\n", err)
-		}
-
-		// encode the session id, so it's human-readable for logging
-		uuid := hex.EncodeToString(cfg.Command.Identifier)
 
-		// match the command that HomeKit wants to perform for the stream uuid
-		switch cfg.Command.Type {
-		case rtp.SessionControlCommandTypeStart:
-			stream := activeStreams.streams[uuid]
-			if stream == nil {
-				return
-			}
-
-			log.Info.Printf("%s: starting stream\n", uuid)
-
-			// lock the stream, so we're not racing with another request to spawn an ffmpeg instance
-			// and update the state
-			stream.mutex.Lock()
-			defer stream.mutex.Unlock()
-
-			// close any previous ffmpeg instances that were open for the given stream uuid
-			if stream.cmd != nil && stream.cmd.Process != nil {
-				log.Info.Printf("%s: requested to start stream, but stream was already running. shutting down previous\n", uuid)
-
-				_ = stream.cmd.Process.Signal(syscall.SIGINT)
-				status, _ := stream.cmd.Process.Wait()
-				log.Info.Printf("%s: ffmpeg exited with %s\n", uuid, status.String())
-
-				stream.cmd = nil
-			}
-
-			// build the endpoint that HomeKit wants us to stream to
-			endpoint := fmt.Sprintf(
-				"srtp://%s:%d?rtcpport=%d&pkt_size=%d",
-				stream.req.ControllerAddr.IPAddr,
-				stream.req.ControllerAddr.VideoRtpPort,
-				stream.req.ControllerAddr.VideoRtpPort,
-				1378,
-			)
-
-			// build the blueiris rtsp source
-			source := blueirisBase.JoinPath(cameraName)
-			source.Scheme = "rtsp"
-			source.User = url.UserPassword(config.Blueiris.Username, config.Blueiris.Password)
-
-			// build ffmpeg command for pulling RTSP stream from BlueIris and forwarding to the HomeKit
-			// controller's SRTP port using pass-through for low CPU, the BlueIris RTSP web server needs
-			// to be set to 2,000kb/s bitrate though otherwise iOS will silently fail
-			cmd := exec.Command(
-				"ffmpeg",
-				// input
-				"-an",
-				"-rtsp_transport", "tcp",
-				"-use_wallclock_as_timestamps", "1",
-				"-i", source.String(),
-				// no audio
-				"-an",
-				// no subs
-				"-sn",
-				// no data
-				"-dn",
-				// add extra keyframes, so we don't need to worry about the blueiris settings
-				"-bsf:v", "dump_extra",
-				// copy data directly from the blueiris stream
-				"-vcodec", "copy",
-				// requested payload type from client
-				"-payload_type", fmt.Sprintf("%d", cfg.Video.RTP.PayloadType),
-				// sync source
-				"-ssrc", fmt.Sprintf("%d", globalState.ssrcVideo),
-				// format rtp
-				"-f", "rtp",
-				// forward over srtp to the controller
-				"-srtp_out_suite", "AES_CM_128_HMAC_SHA1_80",
-				"-srtp_out_params", stream.req.Video.SrtpKey(),
-				endpoint,
-			)
-
-			// forward ffmpeg to console
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			log.Debug.Println(cmd)
-
-			// spawn ffmpeg command
-			err := cmd.Start()
-			if err != nil {
-				log.Info.Printf("Failed to spawn ffmpeg: %s\n", err)
-				return
-			}
-
-			// update our state to contain the spawned command, so we can control it later
-			stream.cmd = cmd
-
-			// sanity check to ensure our status is still available so new clients can still request
-			// streams
-			setTlv8Payload(mgmt.StreamingStatus.Bytes, rtp.StreamingStatus{Status: rtp.StreamingStatusAvailable})
-		case rtp.SessionControlCommandTypeEnd:
-			stream := activeStreams.streams[uuid]
-			if stream == nil {
-				return
-			}
-
-			log.Info.Printf("%s: ending stream\n", uuid)
+		eventOptions.CameraInterval = pollInterval
+		eventOptions.AlertInterval = pollInterval
+	}
+	events := blueiris.NewEvents(bi, eventOptions)
 
-			// lock the stream, so we're not racing with another request on the process and update
-			// the state
-			stream.mutex.Lock()
-			defer stream.mutex.Unlock()
+	go cameraStatuses.Run(events.Subscribe(eventBuffer))
+	if securitySystem != nil {
+		go securitySystem.Run(events.Subscribe(eventBuffer))
+	}
+	if dio != nil {
+		go dio.Run(events.Subscribe(eventBuffer))
+	}
+	if biServer != nil {
+		go biServer.Run(events.Subscribe(eventBuffer))
+	}
 
-			// ensure the stream is still open
-			if stream.cmd == nil || stream.cmd.Process == nil {
-				log.Info.Printf("%s: attempted to end already ended stream\n", uuid)
-				return
+	// drive the motion sensors straight from blueiris' camera states, so users don't need to
+	// set up alert actions for every camera, picking up the objects the AI detected from the
+	// alerts blueiris raises
+	if config.Motion.Poll {
+		go func(events <-chan blueiris.Event) {
+			for event := range events {
+				switch event := event.(type) {
+				case blueiris.CameraTriggered:
+					sensor := motionSensors[event.Camera.Id]
+					if sensor == nil {
+						continue
+					}
+
+					if event.Triggered {
+						sensor.Trigger(nil)
+						captureEventSnapshot(event.Camera.Id, "")
+					} else {
+						sensor.Reset()
+					}
+				case blueiris.NewAlert:
+					// motion itself comes from the camera's state, the alert only tells us what the
+					// AI saw, and may arrive after blueiris has already untriggered the camera
+					if sensor := motionSensors[event.Alert.Camera]; sensor != nil && sensor.Detect(event.Alert.Labels()) {
+						captureEventSnapshot(event.Alert.Camera, event.Alert.Path)
+					}
+				}
 			}
+		}(events.Subscribe(eventBuffer))
+	}
 
-			// send a sigint to ffmpeg and wait for it to finish
-			_ = stream.cmd.Process.Signal(syscall.SIGINT)
-			status, _ := stream.cmd.Process.Wait()
-			log.Info.Printf("%s: ffmpeg exited with %s\n", uuid, status.String())
-
-			// remove command from our state so HomeKit can't attempt to close it twice
-			stream.cmd = nil
+	go events.Run(ctx)
 
-			// sanity check to ensure our status is still available so new clients can still request
-			// streams
-			setTlv8Payload(mgmt.StreamingStatus.Bytes, rtp.StreamingStatus{Status: rtp.StreamingStatusAvailable})
-		case rtp.SessionControlCommandTypeSuspend:
-			stream := activeStreams.streams[uuid]
-			if stream == nil {
-				return
-			}
+	go func() {
+		<-c
+		signal.Stop(c)
 
-			log.Info.Printf("%s: suspending stream\n", uuid)
+		log.Info.Println("shutting down")
 
-			// lock the stream, so we're not racing with another request on the process
-			stream.mutex.Lock()
-			defer stream.mutex.Unlock()
+		// both steps run at once, so the whole shutdown fits within the one timeout
+		wg := &sync.WaitGroup{}
+		wg.Add(2)
 
-			// ensure HomeKit isn't attempting to suspend a closed stream
-			if stream.cmd == nil || stream.cmd.Process == nil {
-				log.Info.Printf("%s: attempted to suspend inactive stream\n", uuid)
-				return
-			}
+		// let any snapshots currently being served finish before we close the server
+		go func() {
+			defer wg.Done()
 
-			// send a sigstop signal to ffmpeg
-			err := stream.cmd.Process.Signal(syscall.SIGSTOP)
-			if err != nil {
-				log.Info.Printf("%s: failed to suspend ffmpeg: %s\n", uuid, err)
-			}
-		case rtp.SessionControlCommandTypeResume:
-			stream := activeStreams.streams[uuid]
-			if stream == nil {
-				return
+			if !inFlight.Drain(shutdownTimeout) {
+				log.Info.Printf("in-flight requests didn't finish within %s\n", shutdownTimeout)
 			}
+		}()
 
-			log.Info.Printf("%s: resuming stream\n", uuid)
+		// tear down all the streams, so we're not leaving orphaned ffmpeg processes behind
+		go func() {
+			defer wg.Done()
 
-			// lock the stream, so we're not racing with another request on the process
-			stream.mutex.Lock()
-			defer stream.mutex.Unlock()
+			globalState.streams.StopAll(shutdownTimeout)
+		}()
 
-			// ensure HomeKit isn't attempting to resume a closed stream
-			if stream.cmd == nil || stream.cmd.Process == nil {
-				log.Info.Printf("%s: attempted to resume inactive stream\n", uuid)
-				return
-			}
+		wg.Wait()
+		cancel()
+	}()
 
-			// send a sigcont signal to ffmpeg
-			err := stream.cmd.Process.Signal(syscall.SIGCONT)
-			if err != nil {
-				log.Info.Printf("%s: failed to resume ffmpeg: %s\n", uuid, err)
-			}
-		case rtp.SessionControlCommandTypeReconfigure:
-			log.Info.Printf("%s: ignoring reconfigure message\n", uuid)
-		default:
-			log.Debug.Printf("%s: Unknown command type %d\n", uuid, cfg.Command.Type)
-		}
-	})
+	// spawn the server
+	err = server.ListenAndServe(ctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Info.Panic(err)
+	}
 }
 
 func setTlv8Payload(c *characteristic.Bytes, v interface{}) {
@@ -581,15 +799,3 @@ func setTlv8Payload(c *characteristic.Bytes, v interface{}) {
 		log.Info.Println(err)
 	}
 }
-
-type Stream struct {
-	mutex *sync.Mutex
-	cmd   *exec.Cmd
-	req   rtp.SetupEndpoints
-	resp  rtp.SetupEndpointsResponse
-}
-
-type ActiveStreams struct {
-	mutex   *sync.Mutex
-	streams map[string]*Stream
-}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"sync"
+	"time"
+)
+
+// MotionTimer drives a camera's motion sensor, and the occupancy sensors for any objects the
+// camera is configured to detect, optionally clearing them after a timeout in case blueiris never
+// tells us the motion has stopped.
+type MotionTimer struct {
+	sensor  *service.MotionSensor
+	objects map[string]*service.OccupancySensor
+	timeout time.Duration
+
+	// called whenever motion is triggered
+	onTrigger []func()
+
+	mutex *sync.Mutex
+	timer *time.Timer
+	// incremented every time the sensor changes, so a timer that fired just as motion was triggered
+	// again doesn't clear the new motion
+	generation int
+}
+
+// NewMotionTimer creates a motion timer for the sensor, a timeout of 0 disables the auto reset.
+func NewMotionTimer(sensor *service.MotionSensor, timeout time.Duration) *MotionTimer {
+	return &MotionTimer{
+		sensor:  sensor,
+		objects: map[string]*service.OccupancySensor{},
+		timeout: timeout,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// AddObject sets an occupancy sensor to be driven by detections of the given object, which is
+// either a category from objectCategories or a label from the AI.
+func (m *MotionTimer) AddObject(object string, sensor *service.OccupancySensor) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.objects[object] = sensor
+}
+
+// OnTrigger registers a function to be called whenever motion is triggered.
+func (m *MotionTimer) OnTrigger(fn func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.onTrigger = append(m.onTrigger, fn)
+}
+
+// Trigger sets the sensor to detecting motion, along with the occupancy sensors for any objects
+// in the labels the AI detected, restarting the auto reset timer.
+func (m *MotionTimer) Trigger(labels []string) {
+	m.mutex.Lock()
+	onTrigger := m.onTrigger
+	defer func() {
+		m.mutex.Unlock()
+
+		for _, fn := range onTrigger {
+			fn()
+		}
+	}()
+
+	m.stopTimer()
+	m.sensor.MotionDetected.SetValue(true)
+	m.detect(labels)
+
+	if m.timeout > 0 {
+		generation := m.generation
+		m.timer = time.AfterFunc(m.timeout, func() {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+
+			if m.generation == generation {
+				m.clear()
+				m.timer = nil
+			}
+		})
+	}
+}
+
+// Detect sets the occupancy sensors for any objects in the labels the AI detected, but only while
+// the sensor is detecting motion, so a late alert can't bring back motion that has since cleared.
+// Returns whether motion was being detected.
+func (m *MotionTimer) Detect(labels []string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.sensor.MotionDetected.Value() {
+		return false
+	}
+
+	m.detect(labels)
+	return true
+}
+
+// Reset clears motion from the sensor, cancelling the auto reset timer.
+func (m *MotionTimer) Reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.stopTimer()
+	m.clear()
+}
+
+// detect sets the occupancy sensors matching the labels, the caller must hold the mutex
+func (m *MotionTimer) detect(labels []string) {
+	for object, sensor := range m.objects {
+		if objectMatchesLabels(object, labels) {
+			sensor.OccupancyDetected.SetValue(characteristic.OccupancyDetectedOccupancyDetected)
+		}
+	}
+}
+
+// clear turns off motion and occupancy, the caller must hold the mutex
+func (m *MotionTimer) clear() {
+	m.sensor.MotionDetected.SetValue(false)
+
+	for _, sensor := range m.objects {
+		sensor.OccupancyDetected.SetValue(characteristic.OccupancyDetectedOccupancyNotDetected)
+	}
+}
+
+// stopTimer cancels the auto reset timer, the caller must hold the mutex
+func (m *MotionTimer) stopTimer() {
+	m.generation++
+
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+// the labels the blueiris AI integrations (DeepStack, CodeProject.AI) give to detected objects,
+// grouped into the categories that can be configured as occupancy sensors on a camera. any
+// configured object that isn't one of these categories is matched against the labels as-is.
+var objectCategories = map[string][]string{
+	"person":  {"person", "people"},
+	"vehicle": {"vehicle", "car", "truck", "bus", "motorcycle", "motorbike", "bicycle", "boat"},
+	"animal":  {"animal", "dog", "cat", "bird", "horse", "sheep", "cow", "bear", "deer", "fox"},
+}
+
+// objectMatchesLabels checks if any of the detected labels belong to the configured object
+func objectMatchesLabels(object string, labels []string) bool {
+	names, isCategory := objectCategories[object]
+	if !isCategory {
+		names = []string{object}
+	}
+
+	for _, label := range labels {
+		for _, name := range names {
+			if label == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"time"
+)
+
+// size of placeholder images when HomeKit doesn't tell us what size it wants
+const (
+	defaultPlaceholderWidth  = 640
+	defaultPlaceholderHeight = 360
+)
+
+// placeholderSnapshot renders an image with the camera's name and status to show in place of a
+// snapshot, when the camera is unavailable and we have nothing cached to show instead.
+func placeholderSnapshot(name string, status string, width int, height int) ([]byte, error) {
+	if width <= 0 || height <= 0 {
+		width = defaultPlaceholderWidth
+		height = defaultPlaceholderHeight
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{R: 40, G: 40, B: 40, A: 255}), image.Point{}, draw.Src)
+
+	drawText(img, img.Bounds().Inset(width/10), []string{name, status})
+
+	return encodeJpeg(img)
+}
+
+// annotateStaleSnapshot draws a banner along the bottom of a snapshot, letting the user know how
+// old the snapshot is.
+func annotateStaleSnapshot(snapshot []byte, fetchedAt time.Time) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(snapshot))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	img := image.NewRGBA(bounds)
+	draw.Draw(img, bounds, src, bounds.Min, draw.Src)
+
+	banner := image.Rect(bounds.Min.X, bounds.Max.Y-bounds.Dy()/8, bounds.Max.X, bounds.Max.Y)
+	draw.Draw(img, banner, image.NewUniform(color.RGBA{A: 160}), image.Point{}, draw.Over)
+
+	age := time.Since(fetchedAt).Round(time.Second)
+	drawText(img, banner.Inset(banner.Dy()/8), []string{fmt.Sprintf("stale, last updated %s ago", age)})
+
+	return encodeJpeg(img)
+}
+
+// drawText renders the lines of text centred within rect, scaled up as large as they'll fit
+func drawText(dst draw.Image, rect image.Rectangle, lines []string) {
+	face := basicfont.Face7x13
+	lineHeight := face.Metrics().Height.Ceil()
+
+	// render the text at the font's native size first
+	textWidth := 0
+	for _, line := range lines {
+		if w := font.MeasureString(face, line).Ceil(); w > textWidth {
+			textWidth = w
+		}
+	}
+
+	text := image.NewRGBA(image.Rect(0, 0, textWidth, lineHeight*len(lines)))
+	drawer := font.Drawer{Dst: text, Src: image.White, Face: face}
+	for i, line := range lines {
+		drawer.Dot = fixed.Point26_6{
+			X: fixed.I((textWidth - font.MeasureString(face, line).Ceil()) / 2),
+			Y: fixed.I(lineHeight*i + face.Metrics().Ascent.Ceil()),
+		}
+		drawer.DrawString(line)
+	}
+
+	// then scale it up by a whole number, so the pixels of the font stay crisp
+	scale := rect.Dx() / text.Bounds().Dx()
+	if s := rect.Dy() / text.Bounds().Dy(); s < scale {
+		scale = s
+	}
+	if scale < 1 {
+		scale = 1
+	}
+
+	size := text.Bounds().Size().Mul(scale)
+	target := image.Rectangle{Min: rect.Min.Add(rect.Size().Sub(size).Div(2))}
+	target.Max = target.Min.Add(size)
+
+	draw.NearestNeighbor.Scale(dst, target, text, text.Bounds(), draw.Over, nil)
+}
+
+func encodeJpeg(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
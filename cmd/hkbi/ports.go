@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// PortAllocator hands out UDP ports for the accessory side of RTP sessions from a fixed range,
+// so they can be opened up in firewalls or mapped through from Docker.
+type PortAllocator struct {
+	mutex *sync.Mutex
+	min   int
+	max   int
+	next  int
+	inUse map[int]bool
+}
+
+// NewPortAllocator creates an allocator for ports between min and max inclusive, if either are
+// 0 the OS will pick a random free port instead.
+func NewPortAllocator(min int, max int) *PortAllocator {
+	return &PortAllocator{
+		mutex: &sync.Mutex{},
+		min:   min,
+		max:   max,
+		next:  min,
+		inUse: map[int]bool{},
+	}
+}
+
+// Listen binds a UDP socket on the given ip to the next free port in the range.
+func (p *PortAllocator) Listen(ip net.IP) (*net.UDPConn, error) {
+	if p.min == 0 || p.max == 0 {
+		return net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// walk the range starting from the port after the last one we handed out, so we're not
+	// immediately reusing a port that a controller might still be sending packets to
+	for i := 0; i <= p.max-p.min; i++ {
+		port := p.next
+		p.next++
+		if p.next > p.max {
+			p.next = p.min
+		}
+
+		if p.inUse[port] {
+			continue
+		}
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		if err != nil {
+			// port is probably in use by something else on the host
+			continue
+		}
+
+		p.inUse[port] = true
+		return conn, nil
+	}
+
+	return nil, errors.New("no free ports left in rtp port range")
+}
+
+// Release closes a socket returned by Listen and allows its port to be handed out again.
+func (p *PortAllocator) Release(conn *net.UDPConn) {
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	_ = conn.Close()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.inUse, port)
+}
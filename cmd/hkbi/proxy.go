@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"github.com/brutella/hap/log"
+	"io"
+	"net"
+	"sync"
+)
+
+// StreamProxy sits between ffmpeg and an https BlueIris, accepting ffmpeg's plain RTSP connection
+// on loopback and forwarding it over a TLS connection we dialed ourselves. ffmpeg can't be given a
+// CA or a pinned certificate for rtsps, so this lets BlueIris' certificate be verified with the
+// same settings as every other request.
+type StreamProxy struct {
+	uuid     string
+	listener net.Listener
+	dial     func(ctx context.Context) (net.Conn, error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex  *sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+
+	wg *sync.WaitGroup
+}
+
+// NewStreamProxy listens on loopback for ffmpeg, connecting each connection it accepts to BlueIris
+// with dial.
+func NewStreamProxy(uuid string, dial func(ctx context.Context) (net.Conn, error)) (*StreamProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := &StreamProxy{
+		uuid:     uuid,
+		listener: listener,
+		dial:     dial,
+		ctx:      ctx,
+		cancel:   cancel,
+		mutex:    &sync.Mutex{},
+		conns:    map[net.Conn]struct{}{},
+		wg:       &sync.WaitGroup{},
+	}
+
+	p.wg.Add(1)
+	go p.serve()
+
+	return p, nil
+}
+
+// Addr returns the loopback address ffmpeg should pull the stream from.
+func (p *StreamProxy) Addr() *net.TCPAddr {
+	return p.listener.Addr().(*net.TCPAddr)
+}
+
+// Close stops accepting connections and closes any that are being forwarded, waiting for the
+// forwarding to finish.
+func (p *StreamProxy) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mutex.Unlock()
+
+	p.cancel()
+	_ = p.listener.Close()
+	p.wg.Wait()
+}
+
+// accepts connections from ffmpeg until the proxy is closed
+func (p *StreamProxy) serve() {
+	defer p.wg.Done()
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		p.wg.Add(1)
+		go p.forward(conn)
+	}
+}
+
+// connects ffmpeg's connection to blueiris, copying between the two until either side hangs up
+func (p *StreamProxy) forward(client net.Conn) {
+	defer p.wg.Done()
+
+	if !p.track(client) {
+		_ = client.Close()
+		return
+	}
+	defer p.untrack(client)
+
+	upstream, err := p.dial(p.ctx)
+	if err != nil {
+		log.Info.Printf("%s: failed to connect to blueiris: %s\n", p.uuid, err)
+		_ = client.Close()
+		return
+	}
+
+	if !p.track(upstream) {
+		_ = client.Close()
+		_ = upstream.Close()
+		return
+	}
+	defer p.untrack(upstream)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+
+	// once either side hangs up there's nothing left to forward, closing both unblocks the other
+	// copy
+	<-done
+	_ = client.Close()
+	_ = upstream.Close()
+	<-done
+}
+
+// track registers a connection to be closed along with the proxy, returning false if the proxy
+// has already been closed
+func (p *StreamProxy) track(conn net.Conn) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return false
+	}
+
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *StreamProxy) untrack(conn net.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.conns, conn)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestUpstream starts an echo server standing in for blueiris, returning a dial func for it
+func newTestUpstream(t *testing.T) func(ctx context.Context) (net.Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", listener.Addr().String())
+	}
+}
+
+func TestStreamProxyForwards(t *testing.T) {
+	proxy, err := NewStreamProxy("test", newTestUpstream(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+
+	if _, err := conn.Write([]byte("OPTIONS")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len("OPTIONS"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "OPTIONS" {
+		t.Errorf("expected the upstream's response to be forwarded back, got %q", buf)
+	}
+}
+
+func TestStreamProxyCloseDisconnects(t *testing.T) {
+	proxy, err := NewStreamProxy("test", newTestUpstream(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+
+	// make sure the connection is being forwarded before closing the proxy
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.Close()
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection to be closed along with the proxy, got %v", err)
+	}
+	if _, err := net.Dial("tcp", proxy.Addr().String()); err == nil {
+		t.Error("expected the proxy to stop accepting connections once closed")
+	}
+}
+
+func TestStreamProxyUpstreamFailure(t *testing.T) {
+	proxy, err := NewStreamProxy("test", func(ctx context.Context) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Err: io.ErrUnexpectedEOF}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected ffmpeg's connection to be closed when blueiris can't be reached, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/brutella/hap/log"
+	"sync"
+	"time"
+)
+
+// StreamRegistry tracks the streams for every camera by their session id, so they can be looked
+// up by HomeKit's session control requests and torn down together when we shut down.
+type StreamRegistry struct {
+	mutex   *sync.Mutex
+	streams map[string]*Stream
+	// set once we've started shutting down, so no new streams are started behind StopAll's back
+	stopping bool
+}
+
+func NewStreamRegistry() *StreamRegistry {
+	return &StreamRegistry{
+		mutex:   &sync.Mutex{},
+		streams: map[string]*Stream{},
+	}
+}
+
+// get looks up the stream for the given session id
+func (r *StreamRegistry) get(uuid string) *Stream {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.streams[uuid]
+}
+
+// add starts tracking a stream, returning the stream it replaced if there was one with the same
+// session id. Once StopAll has been called no new streams are tracked, and add returns false.
+func (r *StreamRegistry) add(stream *Stream) (*Stream, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stopping {
+		return nil, false
+	}
+
+	previous := r.streams[stream.uuid]
+	r.streams[stream.uuid] = stream
+
+	return previous, true
+}
+
+// removeStream stops tracking the stream if it's still the one tracked for its session id,
+// returning whether it was
+func (r *StreamRegistry) removeStream(stream *Stream) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.streams[stream.uuid] != stream {
+		return false
+	}
+
+	delete(r.streams, stream.uuid)
+	return true
+}
+
+// StopAll stops every tracked stream in parallel, giving each ffmpeg process until the timeout
+// to exit cleanly before it's killed, and refuses any new streams from then on.
+func (r *StreamRegistry) StopAll(timeout time.Duration) {
+	r.mutex.Lock()
+	r.stopping = true
+	streams := r.streams
+	r.streams = map[string]*Stream{}
+	r.mutex.Unlock()
+
+	log.Info.Printf("stopping %d streams\n", len(streams))
+
+	wg := &sync.WaitGroup{}
+	for _, stream := range streams {
+		wg.Add(1)
+		go func(stream *Stream) {
+			defer wg.Done()
+			stream.stop(timeout)
+		}(stream)
+	}
+	wg.Wait()
+}
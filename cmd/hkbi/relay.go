@@ -0,0 +1,186 @@
+package main
+
+import (
+	"github.com/brutella/hap/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RtpRelay sits between ffmpeg and a HomeKit controller, forwarding the packets ffmpeg produces on
+// a loopback socket out of the ports we advertised to the controller in SetupEndpoints. This means
+// the controller sees the stream coming from the ports it expects, and gives us somewhere to read
+// the RTCP reports and return audio the controller sends back to us.
+type RtpRelay struct {
+	uuid       string
+	ports      *PortAllocator
+	controller *net.UDPAddr
+
+	// loopback socket ffmpeg sends its srtp stream to
+	local *net.UDPConn
+	// sockets bound to the ports we advertised to the controller
+	video *net.UDPConn
+	audio *net.UDPConn
+
+	mutex    *sync.Mutex
+	lastRtcp time.Time
+	paused   bool
+
+	start *sync.Once
+	wg    *sync.WaitGroup
+}
+
+// NewRtpRelay binds the accessory side video and audio ports on ip for a session, ready to be
+// advertised to the controller.
+func NewRtpRelay(uuid string, ports *PortAllocator, ip net.IP) (*RtpRelay, error) {
+	video, err := ports.Listen(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	audio, err := ports.Listen(ip)
+	if err != nil {
+		ports.Release(video)
+		return nil, err
+	}
+
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		ports.Release(video)
+		ports.Release(audio)
+		return nil, err
+	}
+
+	return &RtpRelay{
+		uuid:  uuid,
+		ports: ports,
+		local: local,
+		video: video,
+		audio: audio,
+		mutex: &sync.Mutex{},
+		start: &sync.Once{},
+		wg:    &sync.WaitGroup{},
+	}, nil
+}
+
+// VideoPort returns the accessory side video port to advertise to the controller.
+func (r *RtpRelay) VideoPort() uint16 {
+	return uint16(r.video.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// AudioPort returns the accessory side audio port to advertise to the controller.
+func (r *RtpRelay) AudioPort() uint16 {
+	return uint16(r.audio.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// LocalAddr returns the loopback address ffmpeg should send the stream to.
+func (r *RtpRelay) LocalAddr() *net.UDPAddr {
+	return r.local.LocalAddr().(*net.UDPAddr)
+}
+
+// LastRtcp returns the time we last received an RTCP packet from the controller.
+func (r *RtpRelay) LastRtcp() time.Time {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.lastRtcp
+}
+
+// SetPaused controls whether packets from ffmpeg are forwarded on to the controller. While paused
+// ffmpeg keeps reading from BlueIris, so the RTSP connection stays alive and the stream can resume
+// instantly, but its output is dropped.
+func (r *RtpRelay) SetPaused(paused bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.paused = paused
+}
+
+// Paused returns whether packets are currently being dropped rather than forwarded.
+func (r *RtpRelay) Paused() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.paused
+}
+
+// Start begins forwarding packets between ffmpeg and the controller, calling it again once the
+// relay is running just resumes forwarding if it was paused.
+func (r *RtpRelay) Start(controller *net.UDPAddr) {
+	r.SetPaused(false)
+
+	r.start.Do(func() {
+		r.controller = controller
+
+		r.wg.Add(3)
+		go r.forwardVideo()
+		go r.receiveRtcp()
+		go r.receiveAudio()
+	})
+}
+
+// Close stops forwarding packets and releases the advertised ports.
+func (r *RtpRelay) Close() {
+	_ = r.local.Close()
+	r.ports.Release(r.video)
+	r.ports.Release(r.audio)
+
+	r.wg.Wait()
+}
+
+// forwards the stream from ffmpeg to the controller
+func (r *RtpRelay) forwardVideo() {
+	defer r.wg.Done()
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := r.local.Read(buf)
+		if err != nil {
+			return
+		}
+
+		if r.Paused() {
+			continue
+		}
+
+		_, err = r.video.WriteToUDP(buf[:n], r.controller)
+		if err != nil {
+			log.Debug.Printf("%s: failed to forward packet to controller: %s\n", r.uuid, err)
+		}
+	}
+}
+
+// receives RTCP reports from the controller on the video port
+func (r *RtpRelay) receiveRtcp() {
+	defer r.wg.Done()
+
+	buf := make([]byte, 2048)
+	for {
+		_, addr, err := r.video.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if !addr.IP.Equal(r.controller.IP) {
+			continue
+		}
+
+		r.mutex.Lock()
+		r.lastRtcp = time.Now()
+		r.mutex.Unlock()
+	}
+}
+
+// drains the audio port, we don't support return audio yet but the controller still expects the
+// port to be open
+func (r *RtpRelay) receiveAudio() {
+	defer r.wg.Done()
+
+	buf := make([]byte, 2048)
+	for {
+		_, err := r.audio.Read(buf)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// how long we wait for a packet before deciding it was dropped
+const relayTestTimeout = 200 * time.Millisecond
+
+// newTestRelay starts a relay on loopback, along with a socket standing in for ffmpeg and one
+// standing in for the controller
+func newTestRelay(t *testing.T, ports *PortAllocator) (relay *RtpRelay, ffmpeg *net.UDPConn, controller *net.UDPConn) {
+	t.Helper()
+
+	relay, err := NewRtpRelay("test", ports, net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = controller.Close() })
+
+	ffmpeg, err = net.DialUDP("udp", nil, relay.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ffmpeg.Close() })
+
+	return relay, ffmpeg, controller
+}
+
+// sendAndReceive sends a packet as ffmpeg, returning whether it made it through to the controller
+func sendAndReceive(t *testing.T, ffmpeg *net.UDPConn, controller *net.UDPConn, payload []byte) bool {
+	t.Helper()
+
+	if _, err := ffmpeg.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	_ = controller.SetReadDeadline(time.Now().Add(relayTestTimeout))
+	n, err := controller.Read(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf[:n], payload) {
+		t.Fatalf("expected packet %q, got %q", payload, buf[:n])
+	}
+
+	return true
+}
+
+func TestRtpRelayForwardsAfterStart(t *testing.T) {
+	relay, ffmpeg, controller := newTestRelay(t, NewPortAllocator(0, 0))
+	defer relay.Close()
+
+	relay.Start(controller.LocalAddr().(*net.UDPAddr))
+
+	if !sendAndReceive(t, ffmpeg, controller, []byte("started")) {
+		t.Error("expected packet to be forwarded after start")
+	}
+}
+
+func TestRtpRelaySuspendAndResume(t *testing.T) {
+	relay, ffmpeg, controller := newTestRelay(t, NewPortAllocator(0, 0))
+	defer relay.Close()
+
+	relay.Start(controller.LocalAddr().(*net.UDPAddr))
+
+	relay.SetPaused(true)
+	if sendAndReceive(t, ffmpeg, controller, []byte("suspended")) {
+		t.Error("expected packet to be dropped while suspended")
+	}
+
+	relay.SetPaused(false)
+	if !sendAndReceive(t, ffmpeg, controller, []byte("resumed")) {
+		t.Error("expected packet to be forwarded after resume")
+	}
+}
+
+func TestRtpRelaySecondStartResetsPaused(t *testing.T) {
+	relay, ffmpeg, controller := newTestRelay(t, NewPortAllocator(0, 0))
+	defer relay.Close()
+
+	relay.Start(controller.LocalAddr().(*net.UDPAddr))
+	relay.SetPaused(true)
+
+	relay.Start(controller.LocalAddr().(*net.UDPAddr))
+	if relay.Paused() {
+		t.Fatal("expected a second start to resume the relay")
+	}
+
+	if !sendAndReceive(t, ffmpeg, controller, []byte("restarted")) {
+		t.Error("expected packet to be forwarded after a second start")
+	}
+}
+
+func TestRtpRelayCloseReleasesPorts(t *testing.T) {
+	// give the allocator a range starting at a port we know is free, with some room in case the
+	// ports after it aren't
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	min := probe.LocalAddr().(*net.UDPAddr).Port
+	_ = probe.Close()
+
+	ports := NewPortAllocator(min, min+9)
+	relay, _, controller := newTestRelay(t, ports)
+	relay.Start(controller.LocalAddr().(*net.UDPAddr))
+
+	if len(ports.inUse) != 2 {
+		t.Fatalf("expected both ports to be in use, got %v", ports.inUse)
+	}
+
+	relay.Close()
+
+	if len(ports.inUse) != 0 {
+		t.Errorf("expected both ports to be released, still in use: %v", ports.inUse)
+	}
+
+	// and the ports should be free to bind again
+	for i := 0; i < 2; i++ {
+		conn, err := ports.Listen(net.IPv4(127, 0, 0, 1))
+		if err != nil {
+			t.Fatalf("failed to rebind released port: %s", err)
+		}
+		ports.Release(conn)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/log"
+	"github.com/w4/hkbi/blueiris"
+	"sync"
+)
+
+type SecuritySystemConfig struct {
+	Enabled bool `toml:"enabled"`
+	// the blueiris profile to switch to for each of HomeKit's security system modes, modes
+	// without a profile can't be selected
+	HomeProfile     *int `toml:"home-profile"`
+	AwayProfile     *int `toml:"away-profile"`
+	NightProfile    *int `toml:"night-profile"`
+	DisarmedProfile *int `toml:"disarmed-profile"`
+	// hold the selected profile, rather than letting blueiris' schedule change it
+	Hold bool `toml:"hold"`
+	// the modes, home, away or night, in which motion raises the alarm
+	AlarmModes []string `toml:"alarm-modes"`
+	// the cameras that can raise the alarm, empty for every camera
+	AlarmCameras []string `toml:"alarm-cameras"`
+}
+
+// maps the names of the modes used in the config to HomeKit's security system states
+var securitySystemModes = map[string]int{
+	"home":  characteristic.SecuritySystemCurrentStateStayArm,
+	"away":  characteristic.SecuritySystemCurrentStateAwayArm,
+	"night": characteristic.SecuritySystemCurrentStateNightArm,
+}
+
+// SecuritySystem exposes blueiris' profiles as a HomeKit security system, with each of the
+// HomeKit modes mapped to a profile.
+type SecuritySystem struct {
+	*accessory.SecuritySystem
+
+	bi     *blueiris.Blueiris
+	config SecuritySystemConfig
+
+	// blueiris profile for each of HomeKit's security system states
+	profiles     map[int]int
+	alarmModes   map[int]bool
+	alarmCameras map[string]bool
+
+	mutex *sync.Mutex
+	// the last state we saw blueiris in, and whether the alarm has been raised in that state
+	state     int
+	alarmed   bool
+	haveState bool
+}
+
+func NewSecuritySystem(bi *blueiris.Blueiris, config SecuritySystemConfig) (*SecuritySystem, error) {
+	s := &SecuritySystem{
+		SecuritySystem: accessory.NewSecuritySystem(accessory.Info{
+			Name:         "Blue Iris",
+			Manufacturer: "HKBI",
+		}),
+		bi:           bi,
+		config:       config,
+		profiles:     map[int]int{},
+		alarmModes:   map[int]bool{},
+		alarmCameras: map[string]bool{},
+		mutex:        &sync.Mutex{},
+	}
+
+	for state, profile := range map[int]*int{
+		characteristic.SecuritySystemTargetStateStayArm:  config.HomeProfile,
+		characteristic.SecuritySystemTargetStateAwayArm:  config.AwayProfile,
+		characteristic.SecuritySystemTargetStateNightArm: config.NightProfile,
+		characteristic.SecuritySystemTargetStateDisarm:   config.DisarmedProfile,
+	} {
+		if profile != nil {
+			s.profiles[state] = *profile
+		}
+	}
+
+	if len(s.profiles) == 0 {
+		return nil, fmt.Errorf("no profiles configured for security system")
+	}
+
+	for _, mode := range config.AlarmModes {
+		state, exists := securitySystemModes[mode]
+		if !exists {
+			return nil, fmt.Errorf("unknown security system mode %s", mode)
+		}
+
+		s.alarmModes[state] = true
+	}
+
+	for _, camera := range config.AlarmCameras {
+		s.alarmCameras[camera] = true
+	}
+
+	// only let HomeKit pick the modes we have a profile for
+	target := s.SecuritySystem.SecuritySystem.SecuritySystemTargetState
+	target.ValidVals = nil
+	for state := characteristic.SecuritySystemTargetStateStayArm; state <= characteristic.SecuritySystemTargetStateDisarm; state++ {
+		if _, exists := s.profiles[state]; exists {
+			target.ValidVals = append(target.ValidVals, state)
+		}
+	}
+
+	target.OnValueRemoteUpdate(func(state int) {
+		profile := s.profiles[state]
+
+		status, err := s.bi.SetProfile(profile, s.config.Hold)
+		if err != nil {
+			log.Info.Printf("failed to switch blueiris to profile %d: %s\n", profile, err)
+			return
+		}
+
+		s.update(status.Profile, state)
+	})
+
+	return s, nil
+}
+
+// Run picks up profile changes made outside of HomeKit from the event loop, until the events
+// channel closes.
+func (s *SecuritySystem) Run(events <-chan blueiris.Event) {
+	for event := range events {
+		if event, ok := event.(blueiris.ProfileChanged); ok {
+			s.update(event.Profile, noRequestedState)
+		}
+	}
+}
+
+// Motion raises the alarm if the camera is one of the alarm cameras, and the security system is
+// in one of the alarm modes.
+func (s *SecuritySystem) Motion(camera string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.haveState || s.alarmed || !s.alarmModes[s.state] {
+		return
+	} else if len(s.alarmCameras) > 0 && !s.alarmCameras[camera] {
+		return
+	}
+
+	log.Info.Printf("motion on %s raised the alarm\n", camera)
+
+	s.alarmed = true
+	s.SecuritySystem.SecuritySystem.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateAlarmTriggered)
+}
+
+// passed to update when the profile change didn't come from the user picking a mode in HomeKit
+const noRequestedState = -1
+
+// update reflects the active blueiris profile in the security system's state, requested being
+// the state the user just picked from HomeKit, if any. the alarm is cleared if the mode has
+// changed or the user picked a mode from HomeKit
+func (s *SecuritySystem) update(profile int, requested int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fromUser := requested != noRequestedState
+
+	// several modes can share a profile, so stick with the mode the user picked, or the one we're
+	// already showing, if it's one of them
+	preferred := requested
+	if !fromUser && s.haveState {
+		preferred = s.state
+	}
+
+	state, ok := s.stateFor(profile, preferred)
+	if !ok {
+		log.Debug.Printf("blueiris profile %d isn't mapped to a security system mode\n", profile)
+		return
+	}
+
+	if fromUser || !s.haveState || state != s.state {
+		s.alarmed = false
+	}
+
+	s.state = state
+	s.haveState = true
+
+	s.SecuritySystem.SecuritySystem.SecuritySystemTargetState.SetValue(state)
+	if !s.alarmed {
+		s.SecuritySystem.SecuritySystem.SecuritySystemCurrentState.SetValue(state)
+	}
+}
+
+// stateFor finds the security system state for the profile, picking preferred if it maps to the
+// profile and otherwise the first state that does in a fixed order, so the same profile always
+// shows as the same mode. the caller must hold the mutex.
+func (s *SecuritySystem) stateFor(profile int, preferred int) (int, bool) {
+	if p, exists := s.profiles[preferred]; exists && p == profile {
+		return preferred, true
+	}
+
+	for state := characteristic.SecuritySystemTargetStateStayArm; state <= characteristic.SecuritySystemTargetStateDisarm; state++ {
+		if p, exists := s.profiles[state]; exists && p == profile {
+			return state, true
+		}
+	}
+
+	return 0, false
+}
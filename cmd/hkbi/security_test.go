@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/brutella/hap/characteristic"
+	"testing"
+)
+
+func newTestSecuritySystem(t *testing.T) *SecuritySystem {
+	home, shared := 1, 2
+
+	s, err := NewSecuritySystem(nil, SecuritySystemConfig{
+		HomeProfile:  &home,
+		AwayProfile:  &shared,
+		NightProfile: &shared,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func currentState(s *SecuritySystem) int {
+	return s.SecuritySystem.SecuritySystem.SecuritySystemCurrentState.Value()
+}
+
+func TestSecuritySystemSharedProfileIsDeterministic(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s := newTestSecuritySystem(t)
+		s.update(2, noRequestedState)
+
+		if state := currentState(s); state != characteristic.SecuritySystemCurrentStateAwayArm {
+			t.Fatalf("expected the first mode mapped to the profile, away, got %d", state)
+		}
+	}
+}
+
+func TestSecuritySystemSharedProfileKeepsRequestedState(t *testing.T) {
+	s := newTestSecuritySystem(t)
+
+	s.update(2, characteristic.SecuritySystemTargetStateNightArm)
+	if state := currentState(s); state != characteristic.SecuritySystemCurrentStateNightArm {
+		t.Fatalf("expected the mode the user picked, night, got %d", state)
+	}
+
+	// blueiris reporting the same profile on the next poll shouldn't flip it to away
+	s.update(2, noRequestedState)
+	if state := currentState(s); state != characteristic.SecuritySystemCurrentStateNightArm {
+		t.Errorf("expected night to be kept, got %d", state)
+	}
+
+	s.update(1, noRequestedState)
+	if state := currentState(s); state != characteristic.SecuritySystemCurrentStateStayArm {
+		t.Errorf("expected home after blueiris changed profile, got %d", state)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/log"
+	"github.com/brutella/hap/service"
+	"github.com/w4/hkbi/blueiris"
+)
+
+type ServerConfig struct {
+	// expose an accessory showing the health of the blueiris server
+	Enabled bool `toml:"enabled"`
+}
+
+// Server exposes the health of the blueiris server as a contact sensor that opens and faults
+// whenever blueiris has logged warnings, along with a switch for the global traffic signal.
+type Server struct {
+	*accessory.A
+
+	bi *blueiris.Blueiris
+
+	warnings *service.ContactSensor
+	fault    *characteristic.StatusFault
+	signal   *service.Switch
+}
+
+func NewServer(bi *blueiris.Blueiris) *Server {
+	s := &Server{
+		A: accessory.New(accessory.Info{
+			Name:         "Blue Iris Server",
+			Manufacturer: "HKBI",
+		}, accessory.TypeSensor),
+		bi:       bi,
+		warnings: service.NewContactSensor(),
+		fault:    characteristic.NewStatusFault(),
+		signal:   service.NewSwitch(),
+	}
+
+	warningsName := characteristic.NewName()
+	warningsName.SetValue("Warnings")
+	s.warnings.AddC(warningsName.C)
+	s.warnings.AddC(s.fault.C)
+	s.AddS(s.warnings.S)
+
+	// the switch is on while the signal is green, yellow is shown as on too since cameras
+	// still record
+	signalName := characteristic.NewName()
+	signalName.SetValue("Signal")
+	s.signal.AddC(signalName.C)
+	s.AddS(s.signal.S)
+
+	s.signal.On.OnValueRemoteUpdate(func(on bool) {
+		signal := blueiris.SignalRed
+		if on {
+			signal = blueiris.SignalGreen
+		}
+
+		status, err := s.bi.SetSignal(signal)
+		if err != nil {
+			log.Info.Printf("failed to set blueiris signal: %s\n", err)
+			s.signal.On.SetValue(!on)
+			return
+		}
+
+		s.update(status)
+	})
+
+	return s
+}
+
+// Run keeps the accessory in sync with the server's status from the event loop, until the
+// events channel closes.
+func (s *Server) Run(events <-chan blueiris.Event) {
+	for event := range events {
+		if event, ok := event.(blueiris.StatusUpdated); ok {
+			s.update(event.Status)
+		}
+	}
+}
+
+// update reflects the server's status in the accessory
+func (s *Server) update(status blueiris.Status) {
+	if status.Warnings > 0 {
+		s.warnings.ContactSensorState.SetValue(characteristic.ContactSensorStateContactNotDetected)
+		s.fault.SetValue(characteristic.StatusFaultGeneralFault)
+	} else {
+		s.warnings.ContactSensorState.SetValue(characteristic.ContactSensorStateContactDetected)
+		s.fault.SetValue(characteristic.StatusFaultNoFault)
+	}
+
+	s.signal.On.SetValue(status.Signal != blueiris.SignalRed)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"github.com/brutella/hap/log"
+	"sync"
+	"time"
+)
+
+// how long a request will wait on a refresh before being served a stale snapshot instead
+const staleSnapshotWait = time.Second
+
+type snapshotKey struct {
+	camera string
+	width  int
+	height int
+}
+
+type snapshotEntry struct {
+	image     []byte
+	fetchedAt time.Time
+	// the in-progress refresh of the entry, if there is one
+	refresh *snapshotRefresh
+}
+
+type snapshotRefresh struct {
+	done  chan struct{}
+	image []byte
+	err   error
+	// the number of requests waiting on the refresh, once they've all gone away the refresh is
+	// cancelled
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// SnapshotCache keeps the latest snapshot of each camera for each size HomeKit has asked for, so
+// every device refreshing the Home app at once doesn't result in a round-trip to BlueIris each.
+// Concurrent requests for the same snapshot share a single fetch, and if BlueIris is slow to
+// respond the previous snapshot is served while the refresh finishes in the background.
+type SnapshotCache struct {
+	mutex   *sync.Mutex
+	ttl     time.Duration
+	entries map[snapshotKey]*snapshotEntry
+	events  map[string]*eventSnapshot
+}
+
+// the frame that triggered a camera's motion sensor, served in place of the live snapshot for a
+// short while so notifications show the actual event
+type eventSnapshot struct {
+	image   []byte
+	expires time.Time
+}
+
+func NewSnapshotCache(ttl time.Duration) *SnapshotCache {
+	return &SnapshotCache{
+		mutex:   &sync.Mutex{},
+		ttl:     ttl,
+		entries: map[snapshotKey]*snapshotEntry{},
+		events:  map[string]*eventSnapshot{},
+	}
+}
+
+// SetEvent stores the frame that triggered an event on the camera, to be served for the given
+// duration.
+func (c *SnapshotCache) SetEvent(camera string, image []byte, duration time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.events[camera] = &eventSnapshot{
+		image:   image,
+		expires: time.Now().Add(duration),
+	}
+}
+
+// Event returns the frame that triggered the most recent event on the camera, if it hasn't
+// expired yet.
+func (c *SnapshotCache) Event(camera string) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	event := c.events[camera]
+	if event == nil {
+		return nil
+	} else if time.Now().After(event.expires) {
+		delete(c.events, camera)
+		return nil
+	}
+
+	return event.image
+}
+
+// Get returns the snapshot for the key, calling fetch to refresh it if the cached snapshot is
+// older than the ttl. The fetch is cancelled if every request waiting on it is cancelled. If the
+// previous snapshot is returned because the refresh failed or is taking too long, staleSince is
+// when it was fetched, otherwise it's zero.
+func (c *SnapshotCache) Get(ctx context.Context, key snapshotKey, fetch func(ctx context.Context) ([]byte, error)) (image []byte, staleSince time.Time, err error) {
+	c.mutex.Lock()
+
+	entry := c.entries[key]
+	if entry == nil {
+		entry = &snapshotEntry{}
+		c.entries[key] = entry
+	}
+
+	// serve straight from the cache if the snapshot is still fresh
+	if entry.image != nil && time.Since(entry.fetchedAt) < c.ttl {
+		image := entry.image
+		c.mutex.Unlock()
+		return image, time.Time{}, nil
+	}
+
+	// join the refresh that's already running, or start a new one
+	refresh := entry.refresh
+	if refresh == nil {
+		var refreshCtx context.Context
+		refresh = &snapshotRefresh{done: make(chan struct{})}
+		refreshCtx, refresh.cancel = context.WithCancel(context.Background())
+		entry.refresh = refresh
+
+		go c.refresh(refreshCtx, key, entry, refresh, fetch)
+	}
+	refresh.waiters++
+
+	stale := entry.image
+	staleFetchedAt := entry.fetchedAt
+	c.mutex.Unlock()
+
+	// nothing to fall back on, so we have to wait for blueiris
+	if stale == nil {
+		select {
+		case <-refresh.done:
+			return refresh.image, time.Time{}, refresh.err
+		case <-ctx.Done():
+			c.leave(entry, refresh)
+			return nil, time.Time{}, ctx.Err()
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		c.leave(entry, refresh)
+		return nil, time.Time{}, ctx.Err()
+	case <-refresh.done:
+		if refresh.err != nil {
+			return stale, staleFetchedAt, nil
+		}
+
+		return refresh.image, time.Time{}, nil
+	case <-time.After(staleSnapshotWait):
+		log.Debug.Printf("serving stale snapshot for %s while waiting on blueiris\n", key.camera)
+		return stale, staleFetchedAt, nil
+	}
+}
+
+// leave stops a request waiting on the refresh, cancelling it if nobody else is waiting. A
+// cancelled refresh is detached from the entry straight away, so requests arriving before the
+// fetch returns start a new refresh rather than joining the cancelled one.
+func (c *SnapshotCache) leave(entry *snapshotEntry, refresh *snapshotRefresh) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	refresh.waiters--
+	if refresh.waiters == 0 {
+		refresh.cancel()
+
+		if entry.refresh == refresh {
+			entry.refresh = nil
+		}
+	}
+}
+
+func (c *SnapshotCache) refresh(ctx context.Context, key snapshotKey, entry *snapshotEntry, refresh *snapshotRefresh, fetch func(ctx context.Context) ([]byte, error)) {
+	defer refresh.cancel()
+
+	refresh.image, refresh.err = fetch(ctx)
+	if refresh.err != nil {
+		log.Info.Printf("failed to fetch snapshot for %s: %s\n", key.camera, refresh.err)
+	}
+
+	c.mutex.Lock()
+	if refresh.err == nil {
+		entry.image = refresh.image
+		entry.fetchedAt = time.Now()
+	}
+	if entry.refresh == refresh {
+		entry.refresh = nil
+	}
+	c.mutex.Unlock()
+
+	close(refresh.done)
+}
+
+// Latest returns the most recently fetched snapshot of the camera at any size, and when it was
+// fetched, for use as a fallback when the camera is unavailable.
+func (c *SnapshotCache) Latest(camera string) ([]byte, time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var image []byte
+	var fetchedAt time.Time
+	for key, entry := range c.entries {
+		if key.camera == camera && entry.image != nil && entry.fetchedAt.After(fetchedAt) {
+			image = entry.image
+			fetchedAt = entry.fetchedAt
+		}
+	}
+
+	return image, fetchedAt
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/brutella/hap/log"
+	"github.com/w4/hkbi/blueiris"
+	"sync"
+	"time"
+)
+
+// how often we ask blueiris for the state of each camera and of the server
+const cameraStatusInterval = 10 * time.Second
+
+// how many events each subscriber to the event loop can fall behind by before holding it up
+const eventBuffer = 16
+
+// CameraStatuses keeps track of the latest state blueiris has reported for each camera, keyed by
+// the camera's short name.
+type CameraStatuses struct {
+	mutex   *sync.RWMutex
+	cameras map[string]blueiris.Camera
+	// called with each camera's state every time it's refreshed
+	onUpdate []func(camera blueiris.Camera)
+}
+
+func NewCameraStatuses(cameras []blueiris.Camera) *CameraStatuses {
+	s := &CameraStatuses{
+		mutex:   &sync.RWMutex{},
+		cameras: map[string]blueiris.Camera{},
+	}
+	s.update(cameras)
+
+	return s
+}
+
+// Get returns the last known state of the camera.
+func (s *CameraStatuses) Get(id string) (blueiris.Camera, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	camera, exists := s.cameras[id]
+	return camera, exists
+}
+
+// IsOnline checks if blueiris last reported the camera as being online.
+func (s *CameraStatuses) IsOnline(id string) bool {
+	camera, exists := s.Get(id)
+	return exists && camera.IsOnline
+}
+
+// OnUpdate registers a function to be called with each camera's state every time it's refreshed.
+func (s *CameraStatuses) OnUpdate(fn func(camera blueiris.Camera)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.onUpdate = append(s.onUpdate, fn)
+}
+
+// Run keeps the camera states up to date from the event loop, until the events channel closes.
+func (s *CameraStatuses) Run(events <-chan blueiris.Event) {
+	for event := range events {
+		if event, ok := event.(blueiris.CamerasUpdated); ok {
+			s.update(event.Cameras)
+		}
+	}
+}
+
+func (s *CameraStatuses) update(cameras []blueiris.Camera) {
+	s.mutex.Lock()
+	onUpdate := s.onUpdate
+	defer func() {
+		s.mutex.Unlock()
+
+		for _, camera := range cameras {
+			for _, fn := range onUpdate {
+				fn(camera)
+			}
+		}
+	}()
+
+	for _, camera := range cameras {
+		previous, exists := s.cameras[camera.Id]
+		if exists && previous.IsOnline != camera.IsOnline {
+			log.Info.Printf("camera %s is now online: %t\n", camera.Id, camera.IsOnline)
+		}
+		if exists && previous.IsHealthy() != camera.IsHealthy() {
+			log.Info.Printf("camera %s is now healthy: %t (signal: %t, fps: %.1f, error: %q)\n",
+				camera.Id, camera.IsHealthy(), !camera.IsNoSignal, camera.Fps, camera.Error)
+		}
+
+		s.cameras[camera.Id] = camera
+	}
+}
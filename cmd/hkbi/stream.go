@@ -0,0 +1,639 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/log"
+	"github.com/brutella/hap/rtp"
+	"github.com/brutella/hap/service"
+	"github.com/brutella/hap/tlv8"
+	"github.com/w4/hkbi/blueiris"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// sets up a camera accessory for streaming
+func startListeningForStreams(cameraName string, mgmt *service.CameraRTPStreamManagement, globalState *GlobalState, config *Config, bi *blueiris.Blueiris) {
+	// add active characteristic to rtpstream
+	active := characteristic.NewActive()
+	mgmt.AddC(active.C)
+
+	// keep our streaming status in sync with the number of streams we're allowed to spawn, so
+	// HomeKit knows when the camera is busy
+	globalState.limiter.Register(cameraName, config.Cameras[cameraName].MaxStreams, func(status byte) {
+		setTlv8Payload(mgmt.StreamingStatus.Bytes, rtp.StreamingStatus{Status: status})
+	})
+
+	// set up some basic parameters for HomeKit to know that the camera is available
+	setTlv8Payload(mgmt.StreamingStatus.Bytes, rtp.StreamingStatus{Status: globalState.limiter.Status(cameraName)})
+	setTlv8Payload(mgmt.SupportedRTPConfiguration.Bytes, rtp.NewConfiguration(rtp.CryptoSuite_AES_CM_128_HMAC_SHA1_80))
+	setTlv8Payload(mgmt.SupportedVideoStreamConfiguration.Bytes, rtp.DefaultVideoStreamConfiguration())
+	setTlv8Payload(mgmt.SupportedAudioStreamConfiguration.Bytes, rtp.DefaultAudioStreamConfiguration())
+
+	// stop tracking a stream and give its slot back, so another client can use it. does nothing
+	// if the stream has already been ended or replaced
+	endStream := func(stream *Stream, reason string) {
+		if !globalState.streams.removeStream(stream) {
+			return
+		}
+
+		globalState.limiter.Release(cameraName)
+
+		log.Info.Printf("%s: ending stream, %s\n", stream.uuid, reason)
+
+		stream.stop(ffmpegStopTimeout)
+	}
+
+	// handle the initial request sent to us from HomeKit to set up a new stream
+	mgmt.SetupEndpoints.OnValueUpdate(func(new, old []byte, r *http.Request) {
+		// HomeKit ends up sending us two requests, but the second one doesn't have a http request attached,
+		// so we can just ignore it
+		if r == nil {
+			return
+		}
+
+		var req rtp.SetupEndpoints
+
+		// unmarshal request from HomeKit
+		err := tlv8.Unmarshal(new, &req)
+		if err != nil {
+			log.Info.Printf("Could not unmarshal tlv8 data: %s\n", err)
+			return
+		}
+
+		// encode the session id, so it's human-readable for logging
+		var uuid = hex.EncodeToString(req.SessionId)
+
+		// reserve a slot for the new stream, unless HomeKit is just setting up an existing session
+		// again, and tell HomeKit we're busy if we've hit our limit or the camera is offline
+		exists := globalState.streams.get(uuid) != nil
+		if !exists && !globalState.limiter.Acquire(cameraName) {
+			log.Info.Printf("%s: refusing to set up stream, camera %s is busy or offline\n", uuid, cameraName)
+
+			setTlv8Payload(mgmt.SetupEndpoints.Bytes, rtp.SetupEndpointsResponse{
+				SessionId: req.SessionId,
+				Status:    rtp.SessionStatusBusy,
+			})
+			return
+		}
+
+		// bind the ports we're going to tell HomeKit to send RTCP and audio to, on the address of
+		// the interface HomeKit connected to us on
+		localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		ip, err := accessoryIP(localAddr, req.ControllerAddr.IPVersion)
+		var relay *RtpRelay
+		if err == nil {
+			relay, err = NewRtpRelay(uuid, globalState.ports, net.ParseIP(ip))
+		}
+		if err != nil {
+			log.Info.Printf("%s: failed to set up stream: %s\n", uuid, err)
+
+			if !exists {
+				globalState.limiter.Release(cameraName)
+			}
+
+			setTlv8Payload(mgmt.SetupEndpoints.Bytes, rtp.SetupEndpointsResponse{
+				SessionId: req.SessionId,
+				Status:    rtp.SessionStatusError,
+			})
+			return
+		}
+
+		// build the response to send back to HomeKit
+		resp := newSetupEndpointsResponse(req, ip, relay.VideoPort(), relay.AudioPort())
+
+		// create and track the new stream
+		stream := &Stream{
+			uuid:      uuid,
+			mutex:     &sync.Mutex{},
+			cmd:       nil,
+			relay:     relay,
+			req:       req,
+			resp:      resp,
+			createdAt: time.Now(),
+			done:      make(chan struct{}),
+			doneOnce:  &sync.Once{},
+		}
+		previous, ok := globalState.streams.add(stream)
+		if !ok {
+			log.Info.Printf("%s: refusing to set up stream, shutting down\n", uuid)
+
+			relay.Close()
+			if !exists {
+				globalState.limiter.Release(cameraName)
+			}
+
+			setTlv8Payload(mgmt.SetupEndpoints.Bytes, rtp.SetupEndpointsResponse{
+				SessionId: req.SessionId,
+				Status:    rtp.SessionStatusError,
+			})
+			return
+		}
+
+		// end the stream ourselves if the controller goes away without telling us
+		go stream.watch(streamIdleTimeout, func(reason string) {
+			endStream(stream, reason)
+		})
+
+		// shut down the stream we're replacing if HomeKit set up the same session twice
+		if previous != nil {
+			previous.stop(ffmpegStopTimeout)
+		}
+
+		// send the response to HomeKit
+		setTlv8Payload(mgmt.SetupEndpoints.Bytes, resp)
+	})
+
+	// handle streaming requests from HomeKit
+	mgmt.SelectedRTPStreamConfiguration.OnValueRemoteUpdate(func(buf []byte) {
+		var cfg rtp.StreamConfiguration
+
+		// unmarshal request from HomeKit
+		err := tlv8.Unmarshal(buf, &cfg)
+		if err != nil {
+			log.Info.Fatalf("Could not unmarshal tlv8 data: %s\n", err)
+		}
+
+		// encode the session id, so it's human-readable for logging
+		uuid := hex.EncodeToString(cfg.Command.Identifier)
+
+		// match the command that HomeKit wants to perform for the stream uuid
+		switch cfg.Command.Type {
+		case rtp.SessionControlCommandTypeStart:
+			stream := globalState.streams.get(uuid)
+			if stream == nil {
+				return
+			}
+
+			log.Info.Printf("%s: starting stream\n", uuid)
+
+			// lock the stream, so we're not racing with another request to spawn an ffmpeg instance
+			// and update the state
+			stream.mutex.Lock()
+			defer stream.mutex.Unlock()
+
+			// the stream may have been ended, or stopped for shutdown, while we were waiting for
+			// it, in which case its relay is closed and nothing would ever stop the ffmpeg we spawn
+			select {
+			case <-stream.done:
+				log.Info.Printf("%s: stream ended before it could be started\n", uuid)
+				return
+			default:
+			}
+
+			// close any previous ffmpeg instances that were open for the given stream uuid
+			if stream.cmd != nil {
+				log.Info.Printf("%s: requested to start stream, but stream was already running. shutting down previous\n", uuid)
+
+				stream.stopFfmpeg(ffmpegStopTimeout)
+			}
+
+			// start forwarding packets to the endpoint HomeKit wants us to stream to, from the port we
+			// advertised to it, a freshly started stream is never suspended
+			stream.startedAt = time.Now()
+			stream.suspendedAt = time.Time{}
+			stream.relay.Start(&net.UDPAddr{
+				IP:   net.ParseIP(stream.req.ControllerAddr.IPAddr),
+				Port: int(stream.req.ControllerAddr.VideoRtpPort),
+			})
+
+			// build the endpoint for ffmpeg to send to our relay
+			endpoint := fmt.Sprintf(
+				"srtp://%s?rtcpport=%d&pkt_size=%d",
+				stream.relay.LocalAddr().String(),
+				stream.relay.LocalAddr().Port,
+				1378,
+			)
+
+			// build the blueiris rtsp source
+			source := bi.StreamUrl(cameraName)
+			source.User = url.UserPassword(config.Blueiris.Username, config.Blueiris.Password)
+
+			// ffmpeg can't verify blueiris' certificate the way we've been configured to, so rtsps
+			// streams are pulled over plain rtsp on loopback, through a proxy that can
+			if source.Scheme == "rtsps" {
+				proxy, err := NewStreamProxy(uuid, bi.DialStream)
+				if err != nil {
+					log.Info.Printf("%s: failed to start stream proxy: %s\n", uuid, err)
+
+					// we're holding the stream's mutex, which ending it needs
+					go endStream(stream, "stream proxy failed to start")
+					return
+				}
+
+				stream.proxy = proxy
+				source.Scheme = "rtsp"
+				source.Host = proxy.Addr().String()
+			}
+
+			// build ffmpeg command for pulling RTSP stream from BlueIris and forwarding to the HomeKit
+			// controller's SRTP port using pass-through for low CPU, the BlueIris RTSP web server needs
+			// to be set to 2,000kb/s bitrate though otherwise iOS will silently fail
+			args := []string{
+				// input
+				"-an",
+				"-rtsp_transport", "tcp",
+				"-use_wallclock_as_timestamps", "1",
+				"-i", source.String(),
+				// no audio
+				"-an",
+				// no subs
+				"-sn",
+				// no data
+				"-dn",
+				// add extra keyframes, so we don't need to worry about the blueiris settings
+				"-bsf:v", "dump_extra",
+				// copy data directly from the blueiris stream
+				"-vcodec", "copy",
+				// requested payload type from client
+				"-payload_type", fmt.Sprintf("%d", cfg.Video.RTP.PayloadType),
+				// sync source
+				"-ssrc", fmt.Sprintf("%d", stream.resp.SsrcVideo),
+				// format rtp
+				"-f", "rtp",
+				// forward over srtp to the controller
+				"-srtp_out_suite", "AES_CM_128_HMAC_SHA1_80",
+				"-srtp_out_params", stream.req.Video.SrtpKey(),
+				endpoint,
+			}
+			cmd := exec.Command("ffmpeg", args...)
+
+			// forward ffmpeg to console
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			log.Debug.Println(cmd)
+
+			// spawn ffmpeg command
+			err := cmd.Start()
+			if err != nil {
+				log.Info.Printf("Failed to spawn ffmpeg: %s\n", err)
+
+				// we're holding the stream's mutex, which ending it needs
+				go endStream(stream, "ffmpeg failed to start")
+				return
+			}
+
+			// update our state to contain the spawned command, so we can control it later
+			stream.cmd = cmd
+			stream.exited = make(chan struct{})
+
+			// reap ffmpeg once it exits, whether that's because we asked it to or not
+			go func(exited chan struct{}) {
+				_ = cmd.Wait()
+				log.Info.Printf("%s: ffmpeg exited with %s\n", uuid, cmd.ProcessState.String())
+				close(exited)
+
+				// if we didn't ask ffmpeg to stop, the stream is dead and its slot needs freeing.
+				// stopFfmpeg clears the command before releasing the mutex, so it's only still set
+				// if ffmpeg exited by itself
+				stream.mutex.Lock()
+				unexpected := stream.cmd == cmd
+				stream.mutex.Unlock()
+
+				if unexpected {
+					endStream(stream, "ffmpeg exited unexpectedly")
+				}
+			}(stream.exited)
+		case rtp.SessionControlCommandTypeEnd:
+			stream := globalState.streams.get(uuid)
+			if stream == nil {
+				return
+			}
+
+			endStream(stream, "requested by controller")
+		case rtp.SessionControlCommandTypeSuspend:
+			stream := globalState.streams.get(uuid)
+			if stream == nil {
+				return
+			}
+
+			log.Info.Printf("%s: suspending stream\n", uuid)
+
+			// lock the stream, so we're not racing with another request on the process
+			stream.mutex.Lock()
+			defer stream.mutex.Unlock()
+
+			// ensure HomeKit isn't attempting to suspend a closed stream
+			if stream.cmd == nil {
+				log.Info.Printf("%s: attempted to suspend inactive stream\n", uuid)
+				return
+			}
+
+			// stop forwarding packets to the controller, ffmpeg keeps running so our RTSP connection
+			// to blueiris doesn't get dropped while we're suspended
+			stream.relay.SetPaused(true)
+			stream.suspendedAt = time.Now()
+		case rtp.SessionControlCommandTypeResume:
+			stream := globalState.streams.get(uuid)
+			if stream == nil {
+				return
+			}
+
+			log.Info.Printf("%s: resuming stream\n", uuid)
+
+			// lock the stream, so we're not racing with another request on the process
+			stream.mutex.Lock()
+			defer stream.mutex.Unlock()
+
+			// ensure HomeKit isn't attempting to resume a closed stream
+			if stream.cmd == nil {
+				log.Info.Printf("%s: attempted to resume inactive stream\n", uuid)
+				return
+			}
+
+			// start forwarding packets to the controller again
+			stream.relay.SetPaused(false)
+			stream.suspendedAt = time.Time{}
+		case rtp.SessionControlCommandTypeReconfigure:
+			log.Info.Printf("%s: ignoring reconfigure message\n", uuid)
+		default:
+			log.Debug.Printf("%s: Unknown command type %d\n", uuid, cfg.Command.Type)
+		}
+	})
+}
+
+// newSetupEndpointsResponse builds the response to a SetupEndpoints request from HomeKit, with
+// a fresh pair of SSRCs for the session and the address and ports HomeKit should send RTCP and
+// audio back to us on.
+func newSetupEndpointsResponse(req rtp.SetupEndpoints, ip string, videoPort uint16, audioPort uint16) rtp.SetupEndpointsResponse {
+	ssrcVideo, ssrcAudio := newSsrcPair()
+
+	return rtp.SetupEndpointsResponse{
+		SessionId: req.SessionId,
+		Status:    rtp.SessionStatusSuccess,
+		AccessoryAddr: rtp.Addr{
+			IPVersion:    req.ControllerAddr.IPVersion,
+			IPAddr:       ip,
+			VideoRtpPort: videoPort,
+			AudioRtpPort: audioPort,
+		},
+		Video:     req.Video,
+		Audio:     req.Audio,
+		SsrcVideo: ssrcVideo,
+		SsrcAudio: ssrcAudio,
+	}
+}
+
+// newSsrcPair generates a random, non-zero and distinct pair of synchronization sources for the
+// video and audio streams of a session
+func newSsrcPair() (int32, int32) {
+	var video, audio int32
+	for video == 0 {
+		video = randomSsrc()
+	}
+	for audio == 0 || audio == video {
+		audio = randomSsrc()
+	}
+
+	return video, audio
+}
+
+func randomSsrc() int32 {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		log.Info.Panic(err)
+	}
+
+	return int32(binary.BigEndian.Uint32(buf[:]) & math.MaxInt32)
+}
+
+// accessoryIP finds the address HomeKit should send RTCP and audio to, using the local address of
+// the connection HomeKit made to us. If the controller asked for a different IP version to the one
+// it connected to us over, an address of that version is picked from the same interface.
+func accessoryIP(localAddr net.Addr, version byte) (string, error) {
+	var ip net.IP
+	switch addr := localAddr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	case nil:
+		return "", errors.New("no local address for request")
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return "", err
+		}
+
+		// strip the zone from link-local ipv6 addresses
+		if i := strings.IndexByte(host, '%'); i != -1 {
+			host = host[:i]
+		}
+
+		ip = net.ParseIP(host)
+	}
+
+	if ip == nil {
+		return "", fmt.Errorf("invalid local address %s", localAddr)
+	}
+
+	if matchesIPVersion(ip, version) {
+		if version == rtp.IPAddrVersionv4 {
+			ip = ip.To4()
+		}
+
+		return ip.String(), nil
+	}
+
+	// find the interface we were contacted on, and pick the first address with the correct version
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		if !containsIP(addrs, ip) {
+			continue
+		}
+
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && matchesIPVersion(ipNet.IP, version) && !ipNet.IP.IsLinkLocalUnicast() {
+				if version == rtp.IPAddrVersionv4 {
+					return ipNet.IP.To4().String(), nil
+				}
+
+				return ipNet.IP.String(), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no address with ip version %d found on the interface for %s", version, ip)
+}
+
+func matchesIPVersion(ip net.IP, version byte) bool {
+	if version == rtp.IPAddrVersionv6 {
+		return ip.To4() == nil
+	}
+
+	return ip.To4() != nil
+}
+
+func containsIP(addrs []net.Addr, ip net.IP) bool {
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// how long we give ffmpeg to exit cleanly after a sigint before killing it
+const ffmpegStopTimeout = 5 * time.Second
+
+// how long a session can go without being started, or without RTCP from a controller we've heard
+// from before, until we assume the controller has gone away without ending it
+const streamIdleTimeout = 30 * time.Second
+
+// how long a session can stay suspended without RTCP before we assume the controller has gone
+// away, controllers may stop sending reports while they're not receiving anything
+const streamSuspendTimeout = 5 * time.Minute
+
+type Stream struct {
+	uuid   string
+	mutex  *sync.Mutex
+	cmd    *exec.Cmd
+	exited chan struct{}
+	proxy  *StreamProxy
+	relay  *RtpRelay
+	req    rtp.SetupEndpoints
+	resp   rtp.SetupEndpointsResponse
+
+	// when the session was set up, last started and suspended, for expiring abandoned sessions
+	createdAt   time.Time
+	startedAt   time.Time
+	suspendedAt time.Time
+
+	// closed once the stream has been stopped
+	done     chan struct{}
+	doneOnce *sync.Once
+}
+
+// watch checks on the stream until it's stopped, calling expire if the controller seems to have
+// abandoned it without ending it.
+func (s *Stream) watch(timeout time.Duration, expire func(reason string)) {
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if reason := s.idle(timeout); reason != "" {
+			expire(reason)
+			return
+		}
+	}
+}
+
+// idle returns why the stream looks abandoned, or an empty string if it doesn't
+func (s *Stream) idle(timeout time.Duration) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.startedAt.IsZero() {
+		if time.Since(s.createdAt) > timeout {
+			return "controller never started it"
+		}
+
+		return ""
+	}
+
+	// if RTCP has never reached us, the port is probably firewalled and its absence says nothing
+	// about whether the controller is still there
+	lastRtcp := s.relay.LastRtcp()
+	if lastRtcp.IsZero() {
+		return ""
+	}
+
+	if !s.suspendedAt.IsZero() {
+		if lastRtcp.Before(s.suspendedAt) {
+			lastRtcp = s.suspendedAt
+		}
+		if time.Since(lastRtcp) > streamSuspendTimeout {
+			return "no rtcp from controller while suspended"
+		}
+
+		return ""
+	}
+
+	if lastRtcp.Before(s.startedAt) {
+		lastRtcp = s.startedAt
+	}
+	if time.Since(lastRtcp) > timeout {
+		return "no rtcp from controller"
+	}
+
+	return ""
+}
+
+// stop shuts down ffmpeg if it's running and releases the ports bound for the stream
+func (s *Stream) stop(timeout time.Duration) {
+	// lock the stream, so we're not racing with another request on the process and update
+	// the state
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	started := s.cmd != nil
+	s.stopFfmpeg(timeout)
+
+	// let the user know if the controller couldn't reach us, this usually means the rtp port
+	// range isn't open in the firewall or mapped through from docker
+	if started && s.relay.LastRtcp().IsZero() {
+		log.Info.Printf("%s: never received rtcp from controller on port %d\n", s.uuid, s.relay.VideoPort())
+	}
+
+	s.relay.Close()
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+// stopFfmpeg sends a sigint to ffmpeg and waits for it to exit, killing it if it doesn't exit
+// within the timeout, then closes the proxy it was pulling the stream through. the caller must
+// hold the stream's mutex.
+func (s *Stream) stopFfmpeg(timeout time.Duration) {
+	defer func() {
+		if s.proxy != nil {
+			s.proxy.Close()
+			s.proxy = nil
+		}
+	}()
+
+	if s.cmd == nil {
+		return
+	}
+
+	_ = s.cmd.Process.Signal(syscall.SIGINT)
+
+	select {
+	case <-s.exited:
+	case <-time.After(timeout):
+		log.Info.Printf("%s: ffmpeg didn't exit within %s, killing\n", s.uuid, timeout)
+
+		_ = s.cmd.Process.Kill()
+		<-s.exited
+	}
+
+	// remove command from our state so HomeKit can't attempt to close it twice
+	s.cmd = nil
+	s.exited = nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/brutella/hap/rtp"
+	"github.com/brutella/hap/service"
+	"github.com/brutella/hap/tlv8"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSetupEndpoints(version byte, ip string) rtp.SetupEndpoints {
+	return rtp.SetupEndpoints{
+		SessionId: []byte("0123456789abcdef"),
+		ControllerAddr: rtp.Addr{
+			IPVersion:    version,
+			IPAddr:       ip,
+			VideoRtpPort: 50000,
+			AudioRtpPort: 50002,
+		},
+	}
+}
+
+func TestNewSetupEndpointsResponseSsrcs(t *testing.T) {
+	req := newTestSetupEndpoints(rtp.IPAddrVersionv4, "127.0.0.1")
+
+	first := newSetupEndpointsResponse(req, "127.0.0.1", 40000, 40002)
+	second := newSetupEndpointsResponse(req, "127.0.0.1", 40000, 40002)
+
+	for _, resp := range []rtp.SetupEndpointsResponse{first, second} {
+		if resp.SsrcVideo == 0 || resp.SsrcAudio == 0 {
+			t.Errorf("expected non-zero ssrcs, got video %d audio %d", resp.SsrcVideo, resp.SsrcAudio)
+		}
+		if resp.SsrcVideo == resp.SsrcAudio {
+			t.Errorf("expected video and audio ssrcs to differ, both were %d", resp.SsrcVideo)
+		}
+	}
+
+	if first.SsrcVideo == second.SsrcVideo || first.SsrcAudio == second.SsrcAudio {
+		t.Errorf("expected ssrcs to differ between sessions, got %d/%d and %d/%d",
+			first.SsrcVideo, first.SsrcAudio, second.SsrcVideo, second.SsrcAudio)
+	}
+}
+
+func TestNewSetupEndpointsResponseAdvertisesRelayPorts(t *testing.T) {
+	relay, err := NewRtpRelay("test", NewPortAllocator(0, 0), net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	req := newTestSetupEndpoints(rtp.IPAddrVersionv4, "127.0.0.1")
+	resp := newSetupEndpointsResponse(req, "127.0.0.1", relay.VideoPort(), relay.AudioPort())
+
+	if resp.Status != rtp.SessionStatusSuccess {
+		t.Errorf("expected success, got status %d", resp.Status)
+	}
+	if resp.AccessoryAddr.VideoRtpPort != relay.VideoPort() || resp.AccessoryAddr.AudioRtpPort != relay.AudioPort() {
+		t.Errorf("expected relay ports %d/%d, got %d/%d", relay.VideoPort(), relay.AudioPort(),
+			resp.AccessoryAddr.VideoRtpPort, resp.AccessoryAddr.AudioRtpPort)
+	}
+	if resp.AccessoryAddr.VideoRtpPort == req.ControllerAddr.VideoRtpPort || resp.AccessoryAddr.AudioRtpPort == req.ControllerAddr.AudioRtpPort {
+		t.Errorf("advertised the controller's ports back to it")
+	}
+}
+
+// an address that only has a string form, like the ones we get for connections over ipv6 with a
+// zone
+type stringAddr string
+
+func (a stringAddr) Network() string { return "tcp" }
+func (a stringAddr) String() string  { return string(a) }
+
+func TestAccessoryIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    net.Addr
+		version byte
+		want    string
+	}{
+		{"ipv4", &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 51826}, rtp.IPAddrVersionv4, "192.168.1.2"},
+		{"ipv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51826}, rtp.IPAddrVersionv6, "2001:db8::1"},
+		{"ipv6 zone", stringAddr("[fe80::1%eth0]:51826"), rtp.IPAddrVersionv6, "fe80::1"},
+		{"ipv4-mapped", &net.TCPAddr{IP: net.ParseIP("::ffff:192.168.1.2"), Port: 51826}, rtp.IPAddrVersionv4, "192.168.1.2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := accessoryIP(test.addr, test.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestAccessoryIPVersionMismatch(t *testing.T) {
+	// a documentation address, so it won't be on any of our interfaces to find an ipv6 address on
+	_, err := accessoryIP(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51826}, rtp.IPAddrVersionv6)
+	if err == nil {
+		t.Error("expected an error when no address of the requested version exists")
+	}
+
+	_, err = accessoryIP(nil, rtp.IPAddrVersionv4)
+	if err == nil {
+		t.Error("expected an error without a local address")
+	}
+}
+
+// writeTestSetupEndpoints writes a SetupEndpoints request to the stream management service as a
+// controller would, returning the response
+func writeTestSetupEndpoints(t *testing.T, mgmt *service.CameraRTPStreamManagement) rtp.SetupEndpointsResponse {
+	t.Helper()
+
+	req := newTestSetupEndpoints(rtp.IPAddrVersionv4, "127.0.0.1")
+	buf, err := tlv8.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpReq := httptest.NewRequest(http.MethodPut, "/characteristics", nil)
+	httpReq = httpReq.WithContext(context.WithValue(httpReq.Context(), http.LocalAddrContextKey,
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 51826}))
+
+	if _, status := mgmt.SetupEndpoints.SetValueRequest(base64.StdEncoding.EncodeToString(buf), httpReq); status != 0 {
+		t.Fatalf("write to SetupEndpoints failed with status %d", status)
+	}
+
+	var resp rtp.SetupEndpointsResponse
+	if err := tlv8.Unmarshal(mgmt.SetupEndpoints.Value(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestSetupEndpointsBusyWhenLimiterFull(t *testing.T) {
+	globalState := &GlobalState{
+		limiter: NewStreamLimiter(1),
+		ports:   NewPortAllocator(0, 0),
+		streams: NewStreamRegistry(),
+	}
+
+	mgmt := service.NewCameraRTPStreamManagement()
+	startListeningForStreams("driveway", mgmt, globalState, &Config{}, nil)
+
+	// take the only slot, as another stream would have
+	if !globalState.limiter.Acquire("driveway") {
+		t.Fatal("failed to acquire the only stream slot")
+	}
+
+	resp := writeTestSetupEndpoints(t, mgmt)
+	if resp.Status != rtp.SessionStatusBusy {
+		t.Errorf("expected busy status, got %d", resp.Status)
+	}
+	if globalState.streams.get("30313233343536373839616263646566") != nil {
+		t.Error("expected no stream to be tracked for the refused session")
+	}
+}
+
+func TestStartIgnoredAfterStreamStopped(t *testing.T) {
+	globalState := &GlobalState{
+		limiter: NewStreamLimiter(1),
+		ports:   NewPortAllocator(0, 0),
+		streams: NewStreamRegistry(),
+	}
+
+	mgmt := service.NewCameraRTPStreamManagement()
+	startListeningForStreams("driveway", mgmt, globalState, &Config{}, nil)
+
+	if resp := writeTestSetupEndpoints(t, mgmt); resp.Status != rtp.SessionStatusSuccess {
+		t.Fatalf("expected success, got status %d", resp.Status)
+	}
+
+	// stopped behind the registry's back, as the idle watcher or shutdown would between the
+	// start command looking the stream up and locking it
+	stream := globalState.streams.get("30313233343536373839616263646566")
+	if stream == nil {
+		t.Fatal("expected the stream to be tracked")
+	}
+	stream.stop(time.Second)
+
+	buf, err := tlv8.Marshal(rtp.StreamConfiguration{
+		Command: rtp.SessionControlCommand{
+			Identifier: []byte("0123456789abcdef"),
+			Type:       rtp.SessionControlCommandTypeStart,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpReq := httptest.NewRequest(http.MethodPut, "/characteristics", nil)
+	if _, status := mgmt.SelectedRTPStreamConfiguration.SetValueRequest(base64.StdEncoding.EncodeToString(buf), httpReq); status != 0 {
+		t.Fatalf("write to SelectedRTPStreamConfiguration failed with status %d", status)
+	}
+
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	if !stream.startedAt.IsZero() || stream.cmd != nil {
+		t.Error("expected a stopped stream not to be started")
+	}
+}
+
+func TestSetupEndpointsRefusedAfterStopAll(t *testing.T) {
+	globalState := &GlobalState{
+		limiter: NewStreamLimiter(1),
+		ports:   NewPortAllocator(0, 0),
+		streams: NewStreamRegistry(),
+	}
+
+	mgmt := service.NewCameraRTPStreamManagement()
+	startListeningForStreams("driveway", mgmt, globalState, &Config{}, nil)
+
+	globalState.streams.StopAll(time.Second)
+
+	resp := writeTestSetupEndpoints(t, mgmt)
+	if resp.Status != rtp.SessionStatusError {
+		t.Errorf("expected error status, got %d", resp.Status)
+	}
+	if globalState.streams.get("30313233343536373839616263646566") != nil {
+		t.Error("expected no stream to be tracked after shutting down")
+	}
+	if !globalState.limiter.Acquire("driveway") {
+		t.Error("expected the refused stream's slot to be released")
+	}
+}
+
+func TestStreamIdle(t *testing.T) {
+	relay, err := NewRtpRelay("test", NewPortAllocator(0, 0), net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	stream := &Stream{
+		uuid:      "test",
+		mutex:     &sync.Mutex{},
+		relay:     relay,
+		createdAt: time.Now(),
+	}
+
+	if reason := stream.idle(time.Minute); reason != "" {
+		t.Errorf("expected a fresh session not to be idle, got %q", reason)
+	}
+
+	stream.createdAt = time.Now().Add(-2 * time.Minute)
+	if reason := stream.idle(time.Minute); reason == "" {
+		t.Error("expected a session that was never started to expire")
+	}
+
+	// without ever hearing from the controller we can't tell if it's gone
+	stream.startedAt = time.Now().Add(-2 * time.Minute)
+	if reason := stream.idle(time.Minute); reason != "" {
+		t.Errorf("expected a started session without rtcp not to expire, got %q", reason)
+	}
+
+	relay.mutex.Lock()
+	relay.lastRtcp = time.Now().Add(-2 * time.Minute)
+	relay.mutex.Unlock()
+	if reason := stream.idle(time.Minute); reason == "" {
+		t.Error("expected a session without recent rtcp to expire")
+	}
+
+	stream.suspendedAt = time.Now().Add(-2 * time.Minute)
+	if reason := stream.idle(time.Minute); reason != "" {
+		t.Errorf("expected a recently suspended session not to expire, got %q", reason)
+	}
+}